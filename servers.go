@@ -2,13 +2,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -16,53 +35,154 @@ import (
 
 var (
 	db              *sql.DB
-	activeUsers     = make(map[string]net.Conn) // Map to store active users and their connections
-	activeUsersLock sync.Mutex                  // Mutex to synchronize access to activeUsers map
+	activeUsers     = make(map[string][]net.Conn) // Map to store active users and their connections
+	activeUsersLock sync.Mutex                    // Mutex to synchronize access to activeUsers map
 )
 
 func main() {
-	// Connect to MySQL database
+	// Configure logging before anything else is logged
 	var err error
-	db, err = sql.Open("mysql", "root@tcp(localhost:3306)/go")
+	logger, err = newLogger(os.Stdout, os.Getenv("BANK_LOG_FORMAT"), os.Getenv("BANK_LOG_LEVEL"), os.Getenv("BANK_LOG_REDACT"))
 	if err != nil {
-		fmt.Println("Error connecting to database:", err)
+		fmt.Println("Error configuring logging:", err)
+		os.Exit(1)
+	}
+
+	// Connect to MySQL database. The session runs in UTC, so DEFAULT
+	// CURRENT_TIMESTAMP columns and NOW() line up with the UTC times the
+	// server passes in as query arguments.
+	db, err = sql.Open("mysql", "root@tcp(localhost:3306)/go?time_zone=%27%2B00%3A00%27")
+	if err != nil {
+		logger.Error("error connecting to database", "err", err)
 		os.Exit(1)
 	}
 	defer db.Close()
 
 	// Check if the database connection is successful
 	if err := db.Ping(); err != nil {
-		fmt.Println("Error pinging database:", err)
+		logger.Error("error pinging database", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("database connected")
+
+	// "servers verify-audit" checks the audit log chain and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(runAuditVerifier())
+	}
+
+	// Serve metrics and health checks over HTTP when an address is configured,
+	// falling back to the BANK_METRICS_ADDR name it had before health checks
+	addr := os.Getenv("BANK_HTTP_ADDR")
+	if addr == "" {
+		addr = os.Getenv("BANK_METRICS_ADDR")
+	}
+	if addr != "" {
+		go startHTTPServer(addr)
+	}
+
+	// Load exchange rates used for cross-currency transfers
+	if err := rateTable.Load(fxRatesFile); err != nil {
+		logger.Error("error loading exchange rates, only same-currency transfers are available", "err", err)
+	}
+
+	// Create the bank-owned accounts before anything can post to them
+	if err := provisionBankAccounts(); err != nil {
+		logger.Error("error provisioning bank accounts", "err", err)
+		os.Exit(1)
+	}
+
+	// Rebuild balances from account event streams when enabled
+	eventSourced = os.Getenv("BANK_EVENT_SOURCED") == "1"
+	if eventSourced {
+		logger.Info("event-sourced accounts enabled")
+	}
+
+	// Configure how long payment requests stay open
+	if ttl := os.Getenv("BANK_PAYMENT_REQUEST_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			logger.Error("invalid BANK_PAYMENT_REQUEST_TTL", "value", ttl)
+			os.Exit(1)
+		}
+		paymentRequestTTL = d
+	}
+
+	// Configure where the event stream is published
+	if sinks := os.Getenv("BANK_EVENT_SINKS"); sinks != "" {
+		eventSinks = sinks
+	}
+	sinks, err := parseEventSinks(eventSinks)
+	if err != nil {
+		logger.Error("error configuring event sinks", "err", err)
 		os.Exit(1)
 	}
-	fmt.Println("Database connected successfully.")
+
+	// Open the coordinator before anything can start a transaction
+	coordinator.Recover()
+
+	// Start background jobs
+	go startInterestScheduler()
+	go startStandingOrderScheduler()
+	go startExpiryScheduler()
+	go startLoanScheduler()
+	go startGoalSweepScheduler()
+	go startStatementScheduler()
+	go startAlertEvaluator()
+	go startWebhookDispatcher()
+	go startAuditSealer()
+	for _, sink := range sinks {
+		go startOutboxRelay(sink)
+	}
 
 	// Start server
 	port := ":8080"
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
-		fmt.Println("Error listening:", err)
+		logger.Error("error listening", "err", err)
 		os.Exit(1)
 	}
 	defer listener.Close()
-	fmt.Println("Server is listening on", port)
+	listening.Store(true)
+	logger.Info("server listening", "port", port)
+
+	// Stop accepting connections on SIGINT or SIGTERM, then drain
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("shutdown started", "signal", sig.String())
+		draining.Store(true)
+		listener.Close()
+		listening.Store(false)
+	}()
 
-	// Accept connections indefinitely
+	// Accept connections until shutdown
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection:", err)
+			if draining.Load() {
+				break
+			}
+			logger.Error("error accepting connection", "err", err)
 			continue
 		}
-		fmt.Println("Client connected.")
-
 		// Handle client connection in a new goroutine
 		go handleClient(conn)
 	}
+	shutdown()
 }
 
 func handleClient(conn net.Conn) {
+	// Count error responses, and this connection while it is open
+	conn = &metricsConn{Conn: conn}
 	defer conn.Close()
+	metrics.ConnectionOpened()
+	defer metrics.ConnectionClosed()
+
+	// Everything logged for this connection carries its ID and remote address
+	connID := newLogID()
+	clientLog := logger.With("conn_id", connID, "remote_addr", conn.RemoteAddr().String())
+	clientLog.Info("client connected")
 
 	conn.SetDeadline(time.Now().Add(10 * time.Minute))
 	var username string // Define username variable outside the switch statement
@@ -71,41 +191,212 @@ func handleClient(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	option, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading option:", err)
+		clientLog.Error("error reading option", "err", err)
 		return
 	}
 	option = strings.TrimSpace(option)
 
+	// New requests are refused once shutdown has started
+	if !startOperation() {
+		fmt.Fprintln(conn, shuttingDownResponse)
+		return
+	}
+
+	// Each option read from the client is a request with its own ID
+	requests := 1
+	requestLog := beginRequest(clientLog, connID, requests, option)
+	start := time.Now()
+
 	switch option {
 	case "1": // Login
-		username = handleLogin(conn, reader) // Store the username returned by handleLogin
+		username = handleLogin(conn, requestLog, reader) // Store the username returned by handleLogin
+		if username != "" {
+			defer removeActiveSession(username, conn)
+			clientLog = clientLog.With("username", username)
+		}
 	case "2": // Register
-		handleRegistration(conn, reader)
+		handleRegistration(conn, requestLog, reader)
 	default:
 		fmt.Fprintln(conn, "Invalid option")
+		finishOperation()
 		return
 	}
+	finishOperation()
+	requestLog.Info("request handled", "duration", time.Since(start))
+	metrics.ObserveCommand(map[string]string{"1": "login", "2": "register"}[option], time.Since(start))
 
 	// After login, handle deposit, withdrawal, transfer options
 	for {
 
 		// Read option from client
 		option, err := reader.ReadString('\n')
+		if err == io.EOF {
+			clientLog.Info("client disconnected")
+			return
+		}
+		if err != nil && draining.Load() {
+			clientLog.Info("session closed at shutdown")
+			return
+		}
 		if err != nil {
-			fmt.Println("Error reading option:", err)
+			clientLog.Error("error reading option", "err", err)
 			return
 		}
 		option = strings.TrimSpace(option)
+		if !startOperation() {
+			fmt.Fprintln(conn, shuttingDownResponse)
+			fmt.Fprintln(conn, "Option selection received")
+			return
+		}
+		requests++
+		requestLog := beginRequest(clientLog, connID, requests, option)
+		start := time.Now()
 
 		switch option {
 		case "1":
-			handleDeposit(conn, reader, username)
+			handleDeposit(conn, requestLog, reader, username)
 
 		case "2":
-			handleWithdraw(conn, reader, username) // Uncomment this line when implementing withdrawal
+			handleWithdraw(conn, requestLog, reader, username) // Uncomment this line when implementing withdrawal
 
 		case "3":
-			handleTransfer(conn, reader, username) // Uncomment this line when implementing transfer
+			handleTransfer(conn, requestLog, reader, username) // Uncomment this line when implementing transfer
+
+		case "4":
+			handleCreateStandingOrder(conn, requestLog, reader, username)
+
+		case "5":
+			handleListStandingOrders(conn, requestLog, username)
+
+		case "6":
+			handleCancelStandingOrder(conn, requestLog, reader, username)
+
+		case "7":
+			handlePlaceHold(conn, requestLog, reader, username)
+
+		case "8":
+			handleListHolds(conn, requestLog, username)
+
+		case "9":
+			handleCaptureHold(conn, requestLog, reader, username)
+
+		case "10":
+			handleReleaseHold(conn, requestLog, reader, username)
+
+		case "11":
+			handleBalance(conn, requestLog, username)
+
+		case "12":
+			handleReverseTransfer(conn, requestLog, reader, username)
+
+		case "13":
+			handleRequestPayment(conn, requestLog, reader, username)
+
+		case "14":
+			handleListPaymentRequests(conn, requestLog, username)
+
+		case "15":
+			handleRespondPaymentRequest(conn, requestLog, reader, username)
+
+		case "16":
+			handleAddPayee(conn, requestLog, reader, username)
+
+		case "17":
+			handleListPayees(conn, requestLog, username)
+
+		case "18":
+			handleRemovePayee(conn, requestLog, reader, username)
+
+		case "19":
+			handleCreateJointAccount(conn, requestLog, reader, username)
+
+		case "20":
+			handleSetJointPermissions(conn, requestLog, reader, username)
+
+		case "21":
+			handleListJointAccounts(conn, requestLog, username)
+
+		case "22":
+			handleJointOperation(conn, requestLog, reader, username)
+
+		case "23":
+			handleApproveJointTransfer(conn, requestLog, reader, username)
+
+		case "24":
+			handleSetAccountStatus(conn, requestLog, reader, username)
+
+		case "25":
+			if handleCloseAccount(conn, requestLog, reader, username) {
+				fmt.Fprintln(conn, "Option selection received")
+				finishOperation()
+				return
+			}
+
+		case "26":
+			handleDisburseLoan(conn, requestLog, reader, username)
+
+		case "27":
+			handleListLoans(conn, requestLog, username)
+
+		case "28":
+			handleLoanSchedule(conn, requestLog, reader, username)
+
+		case "29":
+			handlePayoffQuote(conn, requestLog, reader, username)
+
+		case "30":
+			handlePayOffLoan(conn, requestLog, reader, username)
+
+		case "31":
+			handleCreateGoal(conn, requestLog, reader, username)
+
+		case "32":
+			handleListGoals(conn, requestLog, username)
+
+		case "33":
+			handleAddGoalRule(conn, requestLog, reader, username)
+
+		case "34":
+			handleMoveGoalFunds(conn, requestLog, reader, username)
+
+		case "35":
+			handleCloseGoal(conn, requestLog, reader, username)
+
+		case "36":
+			handleStatement(conn, requestLog, reader, username)
+
+		case "37":
+			handleAddAlertRule(conn, requestLog, reader, username)
+
+		case "38":
+			handleListAlertRules(conn, requestLog, username)
+
+		case "39":
+			handleRemoveAlertRule(conn, requestLog, reader, username)
+
+		case "40":
+			handleRegisterWebhook(conn, requestLog, reader, username)
+
+		case "41":
+			handleListWebhooks(conn, requestLog, username)
+
+		case "42":
+			handleRemoveWebhook(conn, requestLog, reader, username)
+
+		case "43":
+			handleListDeadWebhooks(conn, requestLog, username)
+
+		case "44":
+			handleRetryWebhook(conn, requestLog, reader, username)
+
+		case "45":
+			handleEventStreamStatus(conn, requestLog, username)
+
+		case "46":
+			handleRebuildAccount(conn, requestLog, reader, username)
+
+		case "47":
+			handleVerifyAuditLog(conn, requestLog, username)
 
 		default:
 			fmt.Fprintln(conn, "Invalid option")
@@ -113,15 +404,18 @@ func handleClient(conn net.Conn) {
 
 		// After handling each option selection and sending "Option selection successful" message
 		fmt.Fprintln(conn, "Option selection received")
+		finishOperation()
+		requestLog.Info("request handled", "duration", time.Since(start))
+		metrics.ObserveCommand(commandLabel(option), time.Since(start))
 
 	}
 }
 
-func handleLogin(conn net.Conn, reader *bufio.Reader) string {
+func handleLogin(conn net.Conn, log *slog.Logger, reader *bufio.Reader) string {
 	// Read username from client
 	username, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading username:", err)
+		log.Error("error reading username", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return ""
 	}
@@ -136,7 +430,7 @@ func handleLogin(conn net.Conn, reader *bufio.Reader) string {
 	// Read password from client
 	password, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading password:", err)
+		log.Error("error reading password", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return ""
 	}
@@ -151,28 +445,58 @@ func handleLogin(conn net.Conn, reader *bufio.Reader) string {
 	// Perform authentication (check username and password against the database)
 	validUser, err := dbQueryUserAndPassword(username, password)
 	if err != nil {
-		fmt.Println("Error querying database:", err)
+		log.Error("error querying database", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return ""
 	}
 	if !validUser {
+		auditConn(conn, log, username, "login_failed", "denied", "invalid username or password")
 		conn.Write([]byte("Invalid username or password\n"))
 		return ""
 	}
 
+	// Closed accounts can no longer log in
+	status, err := getAccountStatus(username)
+	if err != nil {
+		log.Error("error getting account status", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return ""
+	}
+	if status == "closed" {
+		auditConn(conn, log, username, "login_failed", "denied", "account is closed")
+		conn.Write([]byte("Account is closed\n"))
+		return ""
+	}
+
 	// Get the user's current balance from the database
-	currentBalance, err := getCurrentBalance(username)
+	balance, err := getBalance(username)
 	if err != nil {
-		fmt.Println("Error getting current balance:", err)
+		log.Error("error getting current balance", "err", err)
 		conn.Write([]byte("Error getting current balance\n"))
 		return ""
 	}
 
-	// Send the current balance to the client
-	conn.Write([]byte(fmt.Sprintf("Welcome %s. | Your current balance is: %.2f\n", username, currentBalance)))
+	// Collect notifications queued while the user was away
+	pending, err := takePendingNotifications(username)
+	if err != nil {
+		log.Error("error getting pending notifications", "err", err)
+	}
+
+	// Tell the user's other sessions, or their next login, about a new address
+	if err := checkLoginAddress(username, conn.RemoteAddr()); err != nil {
+		log.Error("error checking login address", "err", err)
+	}
+
+	// Send the current balance to the client, then any pending notifications
+	message := fmt.Sprintf("Welcome %s. | Your current balance is: %s | Available balance: %s\n", username, formatAmount(balance.Ledger, balance.Currency), formatAmount(balance.Available, balance.Currency))
+	conn.Write([]byte(message))
+	for _, notification := range pending {
+		writePush(conn, notification)
+	}
 
 	// Mark the user as active
-	activeUsers[username] = conn
+	addActiveSession(username, conn)
+	auditConn(conn, log, username, "login", "success", "")
 
 	return username
 }
@@ -188,6 +512,9 @@ type Transaction struct {
 type Coordinator struct {
 	Transactions map[int]Transaction
 	Lock         sync.Mutex
+	nextID       int
+	recovered    bool
+	closed       bool
 }
 
 func NewCoordinator() *Coordinator {
@@ -199,7 +526,47 @@ func NewCoordinator() *Coordinator {
 func (c *Coordinator) Prepare() bool {
 	// Simulate preparation phase
 	// In a real implementation, this function would coordinate with the participating nodes
-	return true
+	// Nothing is prepared before recovery has finished or once closed
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.recovered && !c.closed
+}
+
+// Recover brings the coordinator up at startup. Its transaction log is kept
+// in memory, so there is nothing to replay: transactions interrupted by a
+// crash were rolled back by the database. Any leftover state is dropped.
+func (c *Coordinator) Recover() {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.Transactions = make(map[int]Transaction)
+	c.recovered = true
+}
+
+// Close stops the coordinator from preparing new transactions at shutdown
+// and returns the ones still unfinished, so they can be written to the log
+func (c *Coordinator) Close() []Transaction {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.closed = true
+	var unfinished []Transaction
+	for _, tx := range c.Transactions {
+		unfinished = append(unfinished, tx)
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].ID < unfinished[j].ID })
+	return unfinished
+}
+
+func (c *Coordinator) Recovered() bool {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.recovered
+}
+
+// Closed reports whether Close has been called
+func (c *Coordinator) Closed() bool {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.closed
 }
 
 func (c *Coordinator) Commit() bool {
@@ -214,6 +581,13 @@ func (c *Coordinator) Rollback() bool {
 	return true
 }
 
+func (c *Coordinator) NextID() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
 func (c *Coordinator) AddTransaction(id int, operation, data string) {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
@@ -226,6 +600,13 @@ func (c *Coordinator) RemoveTransaction(id int) {
 	delete(c.Transactions, id)
 }
 
+// InFlight returns the number of transactions added and not yet finished
+func (c *Coordinator) InFlight() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return len(c.Transactions)
+}
+
 func (c *Coordinator) GetTransaction(id int) (Transaction, bool) {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
@@ -235,47 +616,264 @@ func (c *Coordinator) GetTransaction(id int) (Transaction, bool) {
 
 var coordinator = NewCoordinator()
 
-func handleDeposit(conn net.Conn, reader *bufio.Reader, username string) {
+// Currencies and FX
+
+type Currency struct {
+	Code       string
+	MinorUnits int
+}
+
+const defaultCurrency = "USD"
+
+// Supported ISO 4217 currencies and the number of digits after the decimal point
+var currencies = map[string]Currency{
+	"USD": {Code: "USD", MinorUnits: 2},
+	"EUR": {Code: "EUR", MinorUnits: 2},
+	"GBP": {Code: "GBP", MinorUnits: 2},
+	"INR": {Code: "INR", MinorUnits: 2},
+	"JPY": {Code: "JPY", MinorUnits: 0},
+	"KWD": {Code: "KWD", MinorUnits: 3},
+}
+
+func formatAmount(amount float64, currency string) string {
+	cur, ok := currencies[currency]
+	if !ok {
+		return fmt.Sprintf("%.2f %s", amount, currency)
+	}
+	return fmt.Sprintf("%s %.*f", cur.Code, cur.MinorUnits, amount)
+}
+
+func roundToMinorUnits(amount float64, currency string) float64 {
+	cur, ok := currencies[currency]
+	if !ok {
+		cur = currencies[defaultCurrency]
+	}
+	scale := math.Pow(10, float64(cur.MinorUnits))
+	return math.Round(amount*scale) / scale
+}
+
+// parseAmount parses an amount sent by the client and rejects values that are
+// not positive or that carry more decimals than the currency allows
+func parseAmount(amountStr, currency string) (float64, error) {
+	amount, err := strconv.ParseFloat(amountStr, 64)
+	if err != nil {
+		return 0, err
+	}
+	if amount <= 0 {
+		return 0, fmt.Errorf("amount must be positive")
+	}
+	if roundToMinorUnits(amount, currency) != amount {
+		return 0, fmt.Errorf("amount has more decimals than %s allows", currency)
+	}
+	return amount, nil
+}
+
+type RateTable struct {
+	Rates map[string]float64 // Keyed by "FROM/TO"
+	Lock  sync.RWMutex
+}
+
+func NewRateTable() *RateTable {
+	return &RateTable{
+		Rates: make(map[string]float64),
+	}
+}
+
+// Load reads a CSV file of "FROM,TO,RATE" lines, replacing the current rates
+func (r *RateTable) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+
+	rates := make(map[string]float64)
+	for _, record := range records {
+		if len(record) != 3 {
+			return fmt.Errorf("invalid rate line: %v", record)
+		}
+		from := strings.ToUpper(strings.TrimSpace(record[0]))
+		to := strings.ToUpper(strings.TrimSpace(record[1]))
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid rate for %s/%s: %s", from, to, record[2])
+		}
+		rates[from+"/"+to] = rate
+	}
+
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.Rates = rates
+	return nil
+}
+
+// Rate returns how many units of "to" one unit of "from" buys, falling back to
+// the inverse of the opposite pair when only that one is listed
+func (r *RateTable) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	r.Lock.RLock()
+	defer r.Lock.RUnlock()
+	if rate, ok := r.Rates[from+"/"+to]; ok {
+		return rate, nil
+	}
+	if rate, ok := r.Rates[to+"/"+from]; ok {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("no exchange rate for %s to %s", from, to)
+}
+
+var (
+	fxRatesFile = "fx_rates.csv"
+	rateTable   = NewRateTable()
+)
+
+func getAccountCurrency(username string) (string, error) {
+	var currency string
+	err := db.QueryRow("SELECT currency FROM account WHERE username = ?", username).Scan(&currency)
+	if err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+// Ledger
+
+type LedgerEntry struct {
+	Username     string
+	Type         string
+	Amount       float64 // Signed, in the account's currency
+	Currency     string
+	Counterparty string
+	FXRate       sql.NullFloat64
+	ReferenceID  sql.NullInt64
+	InitiatedBy  string // Audited as the actor, the account owner when empty
+}
+
+// recordTransaction appends an entry to the transactions table as part of tx
+func recordTransaction(tx *sql.Tx, entry LedgerEntry) (int64, error) {
+	// In event-sourced mode the entry is also the account's next event, so
+	// the stream is brought in line with the ledger before the entry joins it
+	var aggregate AccountAggregate
+	if eventSourced {
+		var err error
+		if aggregate, _, err = syncAccountStream(tx, entry.Username); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO transactions (username, type, amount, currency, counterparty, fx_rate, reference_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.Username, entry.Type, entry.Amount, entry.Currency, entry.Counterparty, entry.FXRate, entry.ReferenceID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if eventSourced {
+		if err := appendAccountEvent(tx, &aggregate, entry, id); err != nil {
+			return 0, err
+		}
+	}
+
+	// Every balance change is audited with the balances around it
+	if err := auditLedgerEntry(tx, entry, id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// adjustBalance moves an account's balance by delta inside tx. In
+// event-sourced mode the balance is only written as the projection of the
+// stream, when the ledger entry for the change is appended, so it is left
+// alone here.
+func adjustBalance(tx *sql.Tx, account string, delta float64) error {
+	if eventSourced {
+		return nil
+	}
+	_, err := tx.Exec("UPDATE account SET balance = balance + ? WHERE username = ?", delta, account)
+	return err
+}
+
+func handleDeposit(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
 	// Read deposit amount from client
 	amountStr, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading deposit amount:", err)
+		log.Error("error reading deposit amount", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	amountStr = strings.TrimSpace(amountStr)
 
+	// Look up the account currency so the amount can be validated against it
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
 	// Parse the deposit amount
-	amount, err := strconv.ParseFloat(amountStr, 64)
+	amount, err := parseAmount(amountStr, currency)
 	if err != nil {
-		fmt.Println("Error parsing deposit amount:", err)
+		log.Error("error parsing deposit amount", "err", err)
 		conn.Write([]byte("Invalid deposit amount\n"))
 		return
 	}
 
 	// Perform the deposit operation
-	err = depositAmountWithTwoPhaseCommit(username, amount)
+	log.Info("deposit requested", "amount", amount, "currency", currency)
+	err = depositAmountWithTwoPhaseCommit(username, username, amount)
+	auditConn(conn, log, username, "deposit", auditOutcome(err), formatAmount(amount, currency))
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
 	if err != nil {
-		fmt.Println("Error depositing amount:", err)
+		log.Error("error depositing amount", "err", err)
 		conn.Write([]byte("Error depositing amount\n"))
 		return
 	}
 
 	// Get the current balance after the deposit
-	currentBalance, err := getCurrentBalance(username)
+	balance, err := getBalance(username)
 	if err != nil {
-		fmt.Println("Error getting current balance:", err)
+		log.Error("error getting current balance", "err", err)
 		conn.Write([]byte("Error getting current balance\n"))
 		return
 	}
 
 	// Notify the client about the successful deposit and include the current balance
-	message := fmt.Sprintf("Deposit of %.2f successful. Your current balance is %.2f\n", amount, currentBalance)
+	message := fmt.Sprintf("Deposit of %s successful. Your current balance is %s\n", formatAmount(amount, currency), balance)
+
+	conn.Write([]byte(message))
+}
+
+func handleBalance(conn net.Conn, log *slog.Logger, username string) {
+	balance, err := getBalance(username)
+	if err != nil {
+		log.Error("error getting current balance", "err", err)
+		conn.Write([]byte("Error getting current balance\n"))
+		return
+	}
 
+	message := fmt.Sprintf("Ledger balance: %s | Available balance: %s\n", formatAmount(balance.Ledger, balance.Currency), formatAmount(balance.Available, balance.Currency))
 	conn.Write([]byte(message))
 }
 
-func depositAmountWithTwoPhaseCommit(username string, amount float64) error {
+// depositAmountWithTwoPhaseCommit credits amount to username, audited as
+// made by actor
+func depositAmountWithTwoPhaseCommit(actor, username string, amount float64) error {
 	// Start a new transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -289,16 +887,44 @@ func depositAmountWithTwoPhaseCommit(username string, amount float64) error {
 		return fmt.Errorf("transaction preparation failed")
 	}
 
+	// Lock the account row and read its currency and status
+	var currency, status string
+	err = tx.QueryRow("SELECT currency, status FROM account WHERE username = ? FOR UPDATE", username).Scan(&currency, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := checkCanCredit(username, status); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	// Perform the deposit operation
-	_, err = tx.Exec("UPDATE account SET balance = balance + ? WHERE username = ?", amount, username)
+	err = adjustBalance(tx, username, amount)
 	if err != nil {
 		// Rollback if deposit fails
 		_ = tx.Rollback()
 		return err
 	}
 
+	// Record the deposit in the ledger
+	depositID, err := recordTransaction(tx, LedgerEntry{Username: username, Type: "deposit", Amount: amount, Currency: currency, InitiatedBy: actor})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Publish the event with the balance change
+	err = recordAccountEvent(tx, AccountEvent{ID: depositID, Type: "deposit", Account: username, Amount: amount, Currency: currency})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	// Add the transaction to the coordinator
-	coordinator.AddTransaction(txID, "deposit", fmt.Sprintf("%s deposited %.2f", username, amount))
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "deposit", fmt.Sprintf("%s deposited %s", username, formatAmount(amount, currency)))
+	defer coordinator.RemoveTransaction(txID)
 
 	// Commit the transaction
 	if !coordinator.Commit() {
@@ -307,96 +933,215 @@ func depositAmountWithTwoPhaseCommit(username string, amount float64) error {
 		return fmt.Errorf("transaction commit failed")
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func handleWithdraw(conn net.Conn, reader *bufio.Reader, username string) {
+func handleWithdraw(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
 	// Read withdraw amount from client
 	amountStr, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading withdraw amount:", err)
+		log.Error("error reading withdraw amount", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	amountStr = strings.TrimSpace(amountStr)
 
+	// Look up the account currency so the amount can be validated against it
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
 	// Parse the withdraw amount
-	amount, err := strconv.ParseFloat(amountStr, 64)
+	amount, err := parseAmount(amountStr, currency)
 	if err != nil {
-		fmt.Println("Error parsing withdraw amount:", err)
+		log.Error("error parsing withdraw amount", "err", err)
 		conn.Write([]byte("Invalid withdraw amount\n"))
 		return
 	}
 
 	// Perform the withdraw operation
-	err = withdrawAmountWithTwoPhaseCommit(username, amount)
+	log.Info("withdrawal requested", "amount", amount, "currency", currency)
+	fee, err := withdrawAmountWithTwoPhaseCommit(username, username, amount)
+	auditConn(conn, log, username, "withdraw", auditOutcome(err), formatAmount(amount, currency))
+	if errors.Is(err, errInsufficientFunds) {
+		conn.Write([]byte("Insufficient balance\n"))
+		return
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		conn.Write([]byte(limitErr.Response()))
+		return
+	}
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
 	if err != nil {
-		fmt.Println("Error withdrawing amount:", err)
+		log.Error("error withdrawing amount", "err", err)
 		conn.Write([]byte("Error withdrawing amount\n"))
 		return
 	}
 
 	// Get the current balance after the withdrawal
-	currentBalance, err := getCurrentBalance(username)
+	balance, err := getBalance(username)
 	if err != nil {
-		fmt.Println("Error getting current balance:", err)
+		log.Error("error getting current balance", "err", err)
 		conn.Write([]byte("Error getting current balance\n"))
 		return
 	}
 
 	// Notify the client about the successful withdrawal and include the current balance
-	message := fmt.Sprintf("Withdrawal of %.2f successful. Your current balance is %.2f\n", amount, currentBalance)
+	message := fmt.Sprintf("Withdrawal of %s successful.", formatAmount(amount, currency))
+	if fee > 0 {
+		message += fmt.Sprintf(" Fee charged: %s.", formatAmount(fee, currency))
+	}
+	message += fmt.Sprintf(" Your current balance is %s\n", balance)
 	conn.Write([]byte(message))
 }
 
-func withdrawAmountWithTwoPhaseCommit(username string, amount float64) error {
+// withdrawAmountWithTwoPhaseCommit debits amount and its fee from username,
+// audited as made by actor
+func withdrawAmountWithTwoPhaseCommit(actor, username string, amount float64) (float64, error) {
 	// Start a new transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Prepare the transaction
 	if !coordinator.Prepare() {
 		// Rollback if preparation fails
 		_ = tx.Rollback()
-		return fmt.Errorf("transaction preparation failed")
+		return 0, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the account row and read its balance, currency and type
+	var balance float64
+	var currency, accountType, status string
+	var premium bool
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, username); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT balance, currency, account_type, premium, status FROM account WHERE username = ? FOR UPDATE", username).Scan(&balance, &currency, &accountType, &premium, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := checkCanDebit(username, status); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Work out the fee for this withdrawal
+	fee, err := computeFee(tx, "withdraw", accountType, currency, premium, amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Enforce the withdrawal limits while the account row is locked
+	err = checkOutflowLimits(tx, username, accountType, currency, "withdraw", amount, fee)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Check if the available balance covers the withdrawal and its fee
+	available, err := availableBalance(tx, username, balance)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if available < amount+fee {
+		_ = tx.Rollback()
+		return 0, errInsufficientFunds
 	}
 
 	// Perform the withdraw operation
-	_, err = tx.Exec("UPDATE account SET balance = balance - ? WHERE username = ?", amount, username)
+	err = adjustBalance(tx, username, -amount)
 	if err != nil {
 		// Rollback if withdrawal fails
 		_ = tx.Rollback()
-		return err
+		return 0, err
+	}
+
+	// Record the withdrawal in the ledger
+	withdrawID, err := recordTransaction(tx, LedgerEntry{Username: username, Type: "withdraw", Amount: -amount, Currency: currency, InitiatedBy: actor})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Charge the fee as a separate ledger entry
+	err = postFee(tx, actor, username, currency, fee, withdrawID)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Publish the event with the balance change
+	err = recordAccountEvent(tx, AccountEvent{ID: withdrawID, Type: "withdraw", Account: username, Amount: amount, Currency: currency, Fee: fee})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Set the round-up aside in savings goals
+	reached, err := applyRoundUps(tx, username, currency, amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
 	}
 
 	// Add the transaction to the coordinator
-	coordinator.AddTransaction(tx, "withdraw", fmt.Sprintf("%s withdrew %.2f", username, amount))
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "withdraw", fmt.Sprintf("%s withdrew %s", username, formatAmount(amount, currency)))
+	defer coordinator.RemoveTransaction(txID)
 
 	// Commit the transaction
 	if !coordinator.Commit() {
 		// Rollback if commit fails
 		_ = tx.Rollback()
-		return fmt.Errorf("transaction commit failed")
+		return 0, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
 
-	return nil
+	for _, goal := range reached {
+		notifyGoalReached(username, goal, currency)
+	}
+	announceWithdrawal(username, amount, fee, available-amount-fee, currency)
+	return fee, nil
 }
 
-func handleTransfer(conn net.Conn, reader *bufio.Reader, username string) {
+func handleTransfer(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
 	// Read recipient username from the client
 	recipientUsername, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading recipient username:", err)
+		log.Error("error reading recipient username", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	recipientUsername = strings.TrimSpace(recipientUsername)
 
+	// The recipient may be given as the nickname of a saved payee
+	recipientUsername, err = resolvePayee(username, recipientUsername)
+	if err != nil {
+		log.Error("error resolving payee", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
 	// Validate recipient username
 	if recipientUsername == username {
-		fmt.Println("Self-transfer not allowed.")
+		log.Warn("self-transfer not allowed")
 		conn.Write([]byte("Self-transfer not allowed.\n"))
 		return
 	}
@@ -404,89 +1149,292 @@ func handleTransfer(conn net.Conn, reader *bufio.Reader, username string) {
 	// Read transfer amount from the client
 	amountStr, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading transfer amount:", err)
+		log.Error("error reading transfer amount", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	amountStr = strings.TrimSpace(amountStr)
 
+	// The transfer amount is always given in the sender's currency
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
 	// Parse the transfer amount
-	amount, err := strconv.ParseFloat(amountStr, 64)
+	amount, err := parseAmount(amountStr, currency)
 	if err != nil {
-		fmt.Println("Error parsing transfer amount:", err)
+		log.Error("error parsing transfer amount", "err", err)
 		conn.Write([]byte("Invalid transfer amount\n"))
 		return
 	}
 
 	// Perform the transfer operation
-	err = transferAmountWithTwoPhaseCommit(username, recipientUsername, amount)
+	log.Info("transfer requested", "recipient", recipientUsername, "amount", amount, "currency", currency)
+	receipt, err := transferAmountWithTwoPhaseCommit(username, username, recipientUsername, amount)
+	auditConn(conn, log, username, "transfer", auditOutcome(err), fmt.Sprintf("%s to %s", formatAmount(amount, currency), recipientUsername))
+	if errors.Is(err, errInsufficientFunds) {
+		conn.Write([]byte("Insufficient balance for transfer.\n"))
+		return
+	}
+	if errors.Is(err, errRecipientNotFound) {
+		conn.Write([]byte("Recipient not found\n"))
+		return
+	}
+	if errors.Is(err, errPayeeCoolingOff) {
+		conn.Write([]byte(fmt.Sprintf("New payee: transfers above %s are allowed once the %s cooling-off period has passed\n", formatLargeTransferLimit(currency), payeeCoolingOff)))
+		return
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		conn.Write([]byte(limitErr.Response()))
+		return
+	}
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
 	if err != nil {
-		fmt.Println("Error transferring amount:", err)
+		log.Error("error transferring amount", "err", err)
 		conn.Write([]byte("Error transferring amount\n"))
 		return
 	}
 
 	// Get the current balance after the transfer
-	senderCurrentBalance, err := getCurrentBalance(username)
+	senderBalance, err := getBalance(username)
 	if err != nil {
-		fmt.Println("Error getting sender's current balance:", err)
+		log.Error("error getting sender's current balance", "err", err)
 		conn.Write([]byte("Error getting sender's current balance\n"))
 		return
 	}
 
 	// Notify the client about the successful transfer including the current balance
-	message := fmt.Sprintf("Transfer of %.2f to %s successful. Your current balance is %.2f\n", amount, recipientUsername, senderCurrentBalance)
+	message := fmt.Sprintf("Transfer of %s to %s successful (reference %d).", formatAmount(amount, currency), recipientUsername, receipt.ID)
+	if receipt.CreditedCurrency != receipt.Currency {
+		message += fmt.Sprintf(" Recipient credited %s at rate %.6f.", formatAmount(receipt.CreditedAmount, receipt.CreditedCurrency), receipt.Rate)
+	}
+	if receipt.Fee > 0 {
+		message += fmt.Sprintf(" Fee charged: %s.", formatAmount(receipt.Fee, receipt.Currency))
+	}
+	message += fmt.Sprintf(" Your current balance is %s\n", senderBalance)
 	conn.Write([]byte(message))
 }
 
-func transferAmountWithTwoPhaseCommit(sender, recipient string, amount float64) error {
+type TransferReceipt struct {
+	ID               int64   // Ledger entry of the sender's leg
+	Amount           float64 // Debited from the sender, in the sender's currency
+	Currency         string
+	CreditedAmount   float64 // Credited to the recipient, in the recipient's currency
+	CreditedCurrency string
+	Rate             float64
+	Fee              float64 // Charged to the sender on top of Amount
+	Available        float64 // Sender's available balance after the transfer
+}
+
+// transferAmountWithTwoPhaseCommit transfers amount from sender to recipient,
+// audited as made by actor
+func transferAmountWithTwoPhaseCommit(actor, sender, recipient string, amount float64) (TransferReceipt, error) {
 	// Start a new transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return TransferReceipt{}, err
 	}
 
 	// Prepare the transaction
 	if !coordinator.Prepare() {
 		// Rollback if preparation fails
 		_ = tx.Rollback()
-		return fmt.Errorf("transaction preparation failed")
+		return TransferReceipt{}, fmt.Errorf("transaction preparation failed")
 	}
 
-	// Deduct the transfer amount from the sender's balance
-	_, err = tx.Exec("UPDATE account SET balance = balance - ? WHERE username = ?", amount, sender)
+	// Move the funds between both accounts
+	receipt, err := transferFunds(tx, actor, sender, recipient, amount)
 	if err != nil {
-		// Rollback if deduction fails
 		_ = tx.Rollback()
-		return err
+		return TransferReceipt{}, err
 	}
 
 	// Add the transaction to the coordinator
-	coordinator.AddTransaction(tx, "transfer", fmt.Sprintf("%s transferred %.2f to %s", sender, amount, recipient))
-
-	// Add the transfer amount to the recipient's balance
-	_, err = tx.Exec("UPDATE account SET balance = balance + ? WHERE username = ?", amount, recipient)
-	if err != nil {
-		// Rollback if addition fails
-		_ = tx.Rollback()
-		return err
-	}
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "transfer", fmt.Sprintf("%s transferred %s to %s", sender, formatAmount(amount, receipt.Currency), recipient))
+	defer coordinator.RemoveTransaction(txID)
 
 	// Commit the transaction
 	if !coordinator.Commit() {
 		// Rollback if commit fails
 		_ = tx.Rollback()
-		return fmt.Errorf("transaction commit failed")
+		return TransferReceipt{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return TransferReceipt{}, err
 	}
 
-	return nil
+	announceTransfer(sender, recipient, receipt)
+	return receipt, nil
+}
+
+var (
+	errInsufficientFunds = errors.New("insufficient balance")
+	errRecipientNotFound = errors.New("recipient not found")
+)
+
+// transferFunds debits the sender, credits the recipient in their own currency
+// and records both ledger legs inside tx, audited as made by actor. The payee
+// rules applied are the actor's, so an owner's payee limits and cooling-off
+// also hold when they pay from a joint account. The caller owns commit and
+// rollback.
+func transferFunds(tx *sql.Tx, actor, sender, recipient string, amount float64) (TransferReceipt, error) {
+	var receipt TransferReceipt
+
+	// Lock both account rows and read their balances and currencies
+	var senderBalance float64
+	var senderCurrency, senderType, senderStatus, recipientCurrency, recipientStatus string
+	var senderPremium bool
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, sender); err != nil {
+		return receipt, err
+	}
+	err := tx.QueryRow("SELECT balance, currency, account_type, premium, status FROM account WHERE username = ? FOR UPDATE", sender).Scan(&senderBalance, &senderCurrency, &senderType, &senderPremium, &senderStatus)
+	if err != nil {
+		return receipt, err
+	}
+	err = tx.QueryRow("SELECT currency, status FROM account WHERE username = ? FOR UPDATE", recipient).Scan(&recipientCurrency, &recipientStatus)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return receipt, errRecipientNotFound
+		}
+		return receipt, err
+	}
+
+	// Both accounts must be open for the money to move
+	if err := checkCanDebit(sender, senderStatus); err != nil {
+		return receipt, err
+	}
+	if err := checkCanCredit(recipient, recipientStatus); err != nil {
+		return receipt, err
+	}
+
+	// Work out the fee, which the sender pays on top of the amount
+	fee, err := computeFee(tx, "transfer", senderType, senderCurrency, senderPremium, amount)
+	if err != nil {
+		return receipt, err
+	}
+
+	// Check if the sender's available balance covers the transfer and its fee
+	available, err := availableBalance(tx, sender, senderBalance)
+	if err != nil {
+		return receipt, err
+	}
+	if available < amount+fee {
+		return receipt, errInsufficientFunds
+	}
+
+	// Enforce the transfer limits while the sender's row is locked
+	if err := checkOutflowLimits(tx, sender, senderType, senderCurrency, "transfer", amount, fee); err != nil {
+		return receipt, err
+	}
+	payeeAmount, payeeCurrency := amount, senderCurrency
+	if actor != sender {
+		// Payee limits are set in the actor's own currency
+		if payeeCurrency, err = getAccountCurrency(actor); err != nil {
+			return receipt, err
+		}
+		rate, err := rateTable.Rate(senderCurrency, payeeCurrency)
+		if err != nil {
+			return receipt, err
+		}
+		payeeAmount = roundToMinorUnits(amount*rate, payeeCurrency)
+	}
+	if err := checkPayeeRules(tx, actor, recipient, payeeCurrency, payeeAmount); err != nil {
+		return receipt, err
+	}
+
+	receipt, err = postTransfer(tx, actor, sender, recipient, senderCurrency, recipientCurrency, amount, fee)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.Available = available - amount - fee
+	return receipt, nil
+}
+
+// postTransfer moves amount from sender to recipient, converted into the
+// recipient's currency, charges the fee and records the ledger legs and the
+// event inside tx. Both rows must be locked and every check already made.
+// actor is audited as the one who initiated it.
+func postTransfer(tx *sql.Tx, actor, sender, recipient, senderCurrency, recipientCurrency string, amount, fee float64) (TransferReceipt, error) {
+	var receipt TransferReceipt
+
+	// Convert the amount into the recipient's currency
+	rate, err := rateTable.Rate(senderCurrency, recipientCurrency)
+	if err != nil {
+		return receipt, err
+	}
+	credited := roundToMinorUnits(amount*rate, recipientCurrency)
+
+	// Deduct the transfer amount from the sender's balance
+	err = adjustBalance(tx, sender, -amount)
+	if err != nil {
+		return receipt, err
+	}
+
+	// Add the converted amount to the recipient's balance
+	err = adjustBalance(tx, recipient, credited)
+	if err != nil {
+		return receipt, err
+	}
+
+	// Record both legs in the ledger along with the applied rate
+	fxRate := sql.NullFloat64{Float64: rate, Valid: senderCurrency != recipientCurrency}
+	debitID, err := recordTransaction(tx, LedgerEntry{Username: sender, Type: "transfer_out", Amount: -amount, Currency: senderCurrency, Counterparty: recipient, FXRate: fxRate, InitiatedBy: actor})
+	if err != nil {
+		return receipt, err
+	}
+	_, err = recordTransaction(tx, LedgerEntry{Username: recipient, Type: "transfer_in", Amount: credited, Currency: recipientCurrency, Counterparty: sender, FXRate: fxRate, ReferenceID: sql.NullInt64{Int64: debitID, Valid: true}, InitiatedBy: actor})
+	if err != nil {
+		return receipt, err
+	}
+
+	// Charge the fee as a separate ledger entry
+	if err := postFee(tx, actor, sender, senderCurrency, fee, debitID); err != nil {
+		return receipt, err
+	}
+
+	// Publish the event with the balance change
+	err = recordAccountEvent(tx, AccountEvent{
+		ID:               debitID,
+		Type:             "transfer",
+		Account:          sender,
+		Amount:           amount,
+		Currency:         senderCurrency,
+		Fee:              fee,
+		Counterparty:     recipient,
+		CreditedAmount:   credited,
+		CreditedCurrency: recipientCurrency,
+	})
+	if err != nil {
+		return receipt, err
+	}
+
+	receipt = TransferReceipt{
+		ID:               debitID,
+		Amount:           amount,
+		Currency:         senderCurrency,
+		CreditedAmount:   credited,
+		CreditedCurrency: recipientCurrency,
+		Rate:             rate,
+		Fee:              fee,
+	}
+	return receipt, nil
 }
 
-func handleRegistration(conn net.Conn, reader *bufio.Reader) {
+func handleRegistration(conn net.Conn, log *slog.Logger, reader *bufio.Reader) {
 	// Read username, name, and password from client
 	username, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading username:", err)
+		log.Error("error reading username", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
@@ -495,7 +1443,7 @@ func handleRegistration(conn net.Conn, reader *bufio.Reader) {
 	// Read name from client
 	name, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading name:", err)
+		log.Error("error reading name", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
@@ -504,27 +1452,76 @@ func handleRegistration(conn net.Conn, reader *bufio.Reader) {
 	// Read password from client
 	password, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading password:", err)
+		log.Error("error reading password", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	password = strings.TrimSpace(password)
 
+	// Read account currency from client, defaulting when left blank
+	currency, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	// Read account type from client, defaulting when left blank
+	accountType, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading account type", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	accountType = strings.ToLower(strings.TrimSpace(accountType))
+	if accountType == "" {
+		accountType = "checking"
+	}
+
 	// Check if any field is empty
 	if username == "" || name == "" || password == "" {
 		conn.Write([]byte("All fields are required\n"))
 		return
 	}
 
+	// Names with a colon are reserved for joint accounts
+	if strings.Contains(username, ":") {
+		conn.Write([]byte("Username cannot contain ':'\n"))
+		return
+	}
+
+	// Names of bank-owned accounts are reserved too, in any case
+	if strings.HasPrefix(strings.ToLower(username), bankAccountPrefix) {
+		conn.Write([]byte("Usernames starting with '" + bankAccountPrefix + "' are reserved\n"))
+		return
+	}
+
+	// Check if the currency is supported
+	if _, ok := currencies[currency]; !ok {
+		conn.Write([]byte("Unsupported currency\n"))
+		return
+	}
+
+	// Check if the account type is supported
+	if accountType != "checking" && accountType != "savings" {
+		conn.Write([]byte("Unsupported account type\n"))
+		return
+	}
+
 	// Check if username already exists
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&count)
 	if err != nil {
-		fmt.Println("Error querying database:", err)
+		log.Error("error querying database", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 	if count > 0 {
+		auditConn(conn, log, username, "registration", "denied", "username is already taken")
 		conn.Write([]byte("Username is already taken\n"))
 		return
 	}
@@ -532,20 +1529,21 @@ func handleRegistration(conn net.Conn, reader *bufio.Reader) {
 	// Insert new user into the database
 	_, err = db.Exec("INSERT INTO users (username, name, password) VALUES (?, ?, ?)", username, name, password)
 	if err != nil {
-		fmt.Println("Error inserting user into database:", err)
+		log.Error("error inserting user into database", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 
 	// Insert new user into the account table with an initial balance of 0
-	_, err = db.Exec("INSERT INTO account (username, balance) VALUES (?, ?)", username, 0)
+	_, err = db.Exec("INSERT INTO account (username, balance, currency, account_type) VALUES (?, ?, ?, ?)", username, 0, currency, accountType)
 	if err != nil {
-		fmt.Println("Error inserting user into account table:", err)
+		log.Error("error inserting user into account table", "err", err)
 		conn.Write([]byte("Internal server error\n"))
 		return
 	}
 
 	// Registration successful
+	auditConn(conn, log, username, "registration", "success", fmt.Sprintf("%s %s account", currency, accountType))
 	conn.Write([]byte("Registration successful\n"))
 }
 
@@ -560,6 +1558,43 @@ func dbQueryUserAndPassword(username, password string) (bool, error) {
 	return count == 1, nil
 }
 
+// Balance reports both figures of an account: the ledger balance is what has
+// been posted, the available balance is what can still be spent after holds
+type Balance struct {
+	Ledger    float64
+	Available float64
+	Currency  string
+}
+
+func (b Balance) String() string {
+	return fmt.Sprintf("%s (available %s)", formatAmount(b.Ledger, b.Currency), formatAmount(b.Available, b.Currency))
+}
+
+func getBalance(username string) (Balance, error) {
+	var balance Balance
+	err := db.QueryRow("SELECT balance, currency FROM account WHERE username = ?", username).Scan(&balance.Ledger, &balance.Currency)
+	if err != nil {
+		return balance, err
+	}
+	balance.Available, err = availableBalance(db, username, balance.Ledger)
+	return balance, err
+}
+
+// availableBalance derives the available balance from the ledger balance,
+// leaving out holds and money set aside in savings goals. It is the figure
+// every sufficiency check must use.
+func availableBalance(q queryRower, username string, ledger float64) (float64, error) {
+	held, err := heldAmount(q, username)
+	if err != nil {
+		return 0, err
+	}
+	saved, err := goalsAmount(q, username)
+	if err != nil {
+		return 0, err
+	}
+	return ledger - held - saved, nil
+}
+
 func getCurrentBalance(username string) (float64, error) {
 	var balance float64
 	err := db.QueryRow("SELECT balance FROM account WHERE username = ?", username).Scan(&balance)
@@ -578,9 +1613,9 @@ func depositAmount(username string, amount float64) error {
 	defer func() {
 		if err != nil {
 			// Rollback the transaction if there's an error
-			fmt.Println("Rolling back transaction due to error:", err)
+			logger.Error("rolling back transaction due to error", "err", err)
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
-				fmt.Println("Error rolling back transaction:", rollbackErr)
+				logger.Error("error rolling back transaction", "err", rollbackErr)
 			}
 		}
 	}()
@@ -617,9 +1652,9 @@ func withdrawAmount(username string, amount float64) error {
 	defer func() {
 		if err != nil {
 			// Rollback the transaction if there's an error
-			fmt.Println("Rolling back transaction due to error:", err)
+			logger.Error("rolling back transaction due to error", "err", err)
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
-				fmt.Println("Error rolling back transaction:", rollbackErr)
+				logger.Error("error rolling back transaction", "err", rollbackErr)
 			}
 		}
 	}()
@@ -679,9 +1714,9 @@ func transferAmount(sender, recipient string, amount float64) error {
 	defer func() {
 		if err != nil {
 			// Rollback the transaction if there's an error
-			fmt.Println("Rolling back transaction due to error:", err)
+			logger.Error("rolling back transaction due to error", "err", err)
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
-				fmt.Println("Error rolling back transaction:", rollbackErr)
+				logger.Error("error rolling back transaction", "err", rollbackErr)
 			}
 		}
 	}()
@@ -731,3 +1766,7090 @@ func userExists(username string) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// Interest Accrual
+
+type InterestTier struct {
+	MinBalance float64
+	AnnualRate float64
+}
+
+var interestJobInterval = time.Hour
+
+// loadInterestTiers returns the configured tiers for every account type,
+// ordered by ascending minimum balance
+func loadInterestTiers() (map[string][]InterestTier, error) {
+	rows, err := db.Query("SELECT account_type, min_balance, annual_rate FROM interest_tiers ORDER BY account_type, min_balance")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiers := make(map[string][]InterestTier)
+	for rows.Next() {
+		var accountType string
+		var tier InterestTier
+		if err := rows.Scan(&accountType, &tier.MinBalance, &tier.AnnualRate); err != nil {
+			return nil, err
+		}
+		tiers[accountType] = append(tiers[accountType], tier)
+	}
+	return tiers, rows.Err()
+}
+
+// annualRateFor picks the highest tier whose minimum balance is reached
+func annualRateFor(tiers []InterestTier, balance float64) float64 {
+	rate := 0.0
+	for _, tier := range tiers {
+		if balance >= tier.MinBalance {
+			rate = tier.AnnualRate
+		}
+	}
+	return rate
+}
+
+func startInterestScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := runInterestJob(time.Now().UTC()); err != nil {
+			logger.Error("error running interest job", "err", err)
+		}
+		finishOperation()
+		time.Sleep(interestJobInterval)
+	}
+}
+
+// runInterestJob accrues every completed day that has not been accrued yet
+// and posts the accruals of completed months. Both steps are keyed in the
+// database, so running the job again after a restart never repeats a day.
+func runInterestJob(now time.Time) error {
+	tiers, err := loadInterestTiers()
+	if err != nil {
+		return err
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	// Frozen and closed accounts cannot receive money; dormant ones still can
+	rows, err := db.Query("SELECT username, account_type FROM account WHERE status IN ('active', 'dormant')")
+	if err != nil {
+		return err
+	}
+	type eligibleAccount struct {
+		username    string
+		accountType string
+	}
+	var accounts []eligibleAccount
+	for rows.Next() {
+		var account eligibleAccount
+		if err := rows.Scan(&account.username, &account.accountType); err != nil {
+			rows.Close()
+			return err
+		}
+		// Bank-owned revenue and loan accounts never earn interest
+		if strings.HasPrefix(account.username, bankAccountPrefix) {
+			continue
+		}
+		if len(tiers[account.accountType]) > 0 {
+			accounts = append(accounts, account)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if err := accrueInterest(account.username, tiers[account.accountType], today); err != nil {
+			logger.Error("error accruing interest", "account", account.username, "err", err)
+			continue
+		}
+		if err := postInterest(account.username, today); err != nil {
+			logger.Error("error posting interest", "account", account.username, "err", err)
+		}
+	}
+	return nil
+}
+
+// accrueInterest records one accrual per day from the day after the last
+// accrued day up to yesterday, using each day's closing balance
+func accrueInterest(username string, tiers []InterestTier, today time.Time) error {
+	var lastAccrued sql.NullString
+	err := db.QueryRow("SELECT MAX(accrual_date) FROM interest_accruals WHERE username = ?", username).Scan(&lastAccrued)
+	if err != nil {
+		return err
+	}
+
+	day := today.AddDate(0, 0, -1)
+	if lastAccrued.Valid {
+		last, err := time.Parse("2006-01-02", lastAccrued.String)
+		if err != nil {
+			return err
+		}
+		day = last.AddDate(0, 0, 1)
+	}
+
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		balance, err := closingBalance(username, day)
+		if err != nil {
+			return err
+		}
+		if balance <= 0 {
+			continue
+		}
+
+		interest := balance * annualRateFor(tiers, balance) / 365
+		if interest <= 0 {
+			continue
+		}
+
+		// The primary key on (username, accrual_date) rejects a second accrual for the same day
+		_, err = db.Exec("INSERT IGNORE INTO interest_accruals (username, accrual_date, balance, amount) VALUES (?, ?, ?, ?)",
+			username, day.Format("2006-01-02"), balance, interest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closingBalance rebuilds the balance at the end of the UTC day from the
+// current balance and the ledger entries recorded after it
+func closingBalance(username string, day time.Time) (float64, error) {
+	balance, err := getCurrentBalance(username)
+	if err != nil {
+		return 0, err
+	}
+
+	var later float64
+	err = db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE username = ? AND created_at >= ?",
+		username, day.AddDate(0, 0, 1)).Scan(&later)
+	if err != nil {
+		return 0, err
+	}
+	return balance - later, nil
+}
+
+// postInterest credits the unposted accruals of every completed month as a
+// single ledger transaction per month
+func postInterest(username string, today time.Time) error {
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	rows, err := db.Query("SELECT DISTINCT DATE_FORMAT(accrual_date, '%Y-%m-01') FROM interest_accruals WHERE username = ? AND posted_transaction_id IS NULL AND accrual_date < ?",
+		username, monthStart.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	var months []string
+	for rows.Next() {
+		var month string
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, month)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, month := range months {
+		if err := postMonthlyInterest(username, month); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func postMonthlyInterest(username, month string) error {
+	start, err := time.Parse("2006-01-02", month)
+	if err != nil {
+		return err
+	}
+	end := start.AddDate(0, 1, 0)
+
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the account row, which also keeps a concurrent run from posting the same month
+	var currency string
+	err = tx.QueryRow("SELECT currency FROM account WHERE username = ? FOR UPDATE", username).Scan(&currency)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Sum the month's unposted accruals
+	var total float64
+	err = tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM interest_accruals WHERE username = ? AND posted_transaction_id IS NULL AND accrual_date >= ? AND accrual_date < ?",
+		username, start.Format("2006-01-02"), end.Format("2006-01-02")).Scan(&total)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	interest := roundToMinorUnits(total, currency)
+
+	// Credit the interest and record it in the ledger
+	var transactionID int64
+	if interest > 0 {
+		err = adjustBalance(tx, username, interest)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		transactionID, err = recordTransaction(tx, LedgerEntry{Username: username, Type: "interest", Amount: interest, Currency: currency})
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// Mark the accruals as posted, even when they round down to nothing
+	_, err = tx.Exec("UPDATE interest_accruals SET posted_transaction_id = ? WHERE username = ? AND posted_transaction_id IS NULL AND accrual_date >= ? AND accrual_date < ?",
+		transactionID, username, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "interest", fmt.Sprintf("%s credited %s interest for %s", username, formatAmount(interest, currency), start.Format("2006-01")))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return fmt.Errorf("transaction commit failed")
+	}
+
+	return tx.Commit()
+}
+
+// Notifications
+
+// notifyUser pushes a message to the user's open sessions. It is stored
+// either way, and delivered at the next login if no session received it.
+func notifyUser(username, message string) error {
+	delivered := pushToUser(username, message)
+	_, err := db.Exec("INSERT INTO notifications (username, message, delivered) VALUES (?, ?, ?)", username, message, delivered)
+	return err
+}
+
+// takePendingNotifications returns the undelivered notifications of a user
+// in the order they were queued and marks them as delivered
+func takePendingNotifications(username string) ([]string, error) {
+	rows, err := db.Query("SELECT id, message FROM notifications WHERE username = ? AND delivered = FALSE ORDER BY id", username)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var messages []string
+	for rows.Next() {
+		var id int64
+		var message string
+		if err := rows.Scan(&id, &message); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := db.Exec("UPDATE notifications SET delivered = TRUE WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// Standing Orders
+
+type StandingOrder struct {
+	ID         int64
+	Username   string
+	Recipient  string
+	Amount     float64
+	Frequency  string // once, daily, weekly or monthly
+	StartDate  time.Time
+	EndDate    sql.NullString
+	NextRun    time.Time
+	Occurrence int // Number of occurrences already processed
+	Retries    int // Failed attempts of the current occurrence
+}
+
+var (
+	standingOrderInterval   = time.Minute
+	standingOrderRetryDelay = time.Hour
+	standingOrderMaxRetries = 3
+)
+
+const dateLayout = "2006-01-02"
+
+func handleCreateStandingOrder(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read recipient, amount, frequency, start date and end date from client
+	fields := make([]string, 5)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading standing order", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	recipient, amountStr, frequency, startStr, endStr := fields[0], fields[1], strings.ToLower(fields[2]), fields[3], fields[4]
+
+	// Validate recipient username
+	if recipient == username {
+		conn.Write([]byte("Self-transfer not allowed.\n"))
+		return
+	}
+	exists, err := userExists(recipient)
+	if err != nil {
+		log.Error("error checking recipient", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte("Recipient not found\n"))
+		return
+	}
+
+	// Parse the amount in the sender's currency
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid transfer amount\n"))
+		return
+	}
+
+	// Validate frequency and dates
+	if frequency != "once" && frequency != "daily" && frequency != "weekly" && frequency != "monthly" {
+		conn.Write([]byte("Invalid frequency\n"))
+		return
+	}
+	startDate, err := time.Parse(dateLayout, startStr)
+	if err != nil || startDate.Before(today()) {
+		conn.Write([]byte("Invalid start date\n"))
+		return
+	}
+	endDate := sql.NullString{String: endStr, Valid: endStr != ""}
+	if endDate.Valid {
+		end, err := time.Parse(dateLayout, endStr)
+		if err != nil || end.Before(startDate) {
+			conn.Write([]byte("Invalid end date\n"))
+			return
+		}
+	}
+
+	// Store the standing order
+	result, err := db.Exec("INSERT INTO standing_orders (username, recipient, amount, frequency, start_date, end_date, next_run) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		username, recipient, amount, frequency, startStr, endDate, startStr)
+	if err != nil {
+		log.Error("error inserting standing order", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error("error inserting standing order", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Standing order %d created. First transfer of %s to %s on %s\n", id, formatAmount(amount, currency), recipient, startStr)))
+}
+
+func handleListStandingOrders(conn net.Conn, log *slog.Logger, username string) {
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	rows, err := db.Query("SELECT id, recipient, amount, frequency, next_run, end_date FROM standing_orders WHERE username = ? AND status = 'active' ORDER BY next_run, id", username)
+	if err != nil {
+		log.Error("error querying standing orders", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var id int64
+		var recipient, frequency, nextRun string
+		var amount float64
+		var endDate sql.NullString
+		if err := rows.Scan(&id, &recipient, &amount, &frequency, &nextRun, &endDate); err != nil {
+			log.Error("error reading standing order", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("#%d: %s to %s, %s, next on %s", id, formatAmount(amount, currency), recipient, frequency, nextRun)
+		if endDate.Valid {
+			message += ", until " + endDate.String
+		}
+		message += "\n"
+	}
+	if message == "" {
+		message = "No standing orders\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleCancelStandingOrder(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read standing order ID from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading standing order ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid standing order ID\n"))
+		return
+	}
+
+	// Only the owner can cancel an order, and only while it is active
+	result, err := db.Exec("UPDATE standing_orders SET status = 'cancelled' WHERE id = ? AND username = ? AND status = 'active'", id, username)
+	if err != nil {
+		log.Error("error cancelling standing order", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		conn.Write([]byte("Standing order not found\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Standing order %d cancelled\n", id)))
+}
+
+func today() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// addMonthsClamped adds months to date, clamping to the last day of the
+// target month so an order started on the 31st still runs in short months
+func addMonthsClamped(date time.Time, months int) time.Time {
+	first := time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := date.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+// occurrenceDate returns the date of the nth occurrence of an order, counting from zero
+func occurrenceDate(order StandingOrder, n int) time.Time {
+	switch order.Frequency {
+	case "daily":
+		return order.StartDate.AddDate(0, 0, n)
+	case "weekly":
+		return order.StartDate.AddDate(0, 0, 7*n)
+	case "monthly":
+		return addMonthsClamped(order.StartDate, n)
+	}
+	return order.StartDate
+}
+
+func startStandingOrderScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := runStandingOrders(time.Now().UTC()); err != nil {
+			logger.Error("error running standing orders", "err", err)
+		}
+		finishOperation()
+		time.Sleep(standingOrderInterval)
+	}
+}
+
+func runStandingOrders(now time.Time) error {
+	rows, err := db.Query("SELECT id FROM standing_orders WHERE status = 'active' AND next_run <= ? AND (retry_at IS NULL OR retry_at <= ?) ORDER BY next_run, id",
+		now.Format(dateLayout), now)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := executeStandingOrder(id, now); err != nil {
+			logger.Error("error executing standing order", "order", id, "err", err)
+		}
+	}
+	return nil
+}
+
+// lockStandingOrder loads an active order inside tx, locking its row so the
+// same occurrence cannot be executed twice
+func lockStandingOrder(tx *sql.Tx, id int64) (StandingOrder, error) {
+	var order StandingOrder
+	var startDate, nextRun string
+	err := tx.QueryRow("SELECT id, username, recipient, amount, frequency, start_date, end_date, next_run, occurrence, retries FROM standing_orders WHERE id = ? AND status = 'active' FOR UPDATE", id).
+		Scan(&order.ID, &order.Username, &order.Recipient, &order.Amount, &order.Frequency, &startDate, &order.EndDate, &nextRun, &order.Occurrence, &order.Retries)
+	if err != nil {
+		return order, err
+	}
+	if order.StartDate, err = time.Parse(dateLayout, startDate); err != nil {
+		return order, err
+	}
+	if order.NextRun, err = time.Parse(dateLayout, nextRun); err != nil {
+		return order, err
+	}
+	return order, nil
+}
+
+// advanceStandingOrder moves an order to its next occurrence, completing it
+// when there is none left
+func advanceStandingOrder(tx *sql.Tx, order StandingOrder) error {
+	occurrence := order.Occurrence + 1
+	next := occurrenceDate(order, occurrence)
+
+	status := "active"
+	if order.Frequency == "once" {
+		status = "completed"
+	}
+	if order.EndDate.Valid && next.Format(dateLayout) > order.EndDate.String {
+		status = "completed"
+	}
+
+	_, err := tx.Exec("UPDATE standing_orders SET occurrence = ?, next_run = ?, retries = 0, retry_at = NULL, status = ? WHERE id = ?",
+		occurrence, next.Format(dateLayout), status, order.ID)
+	return err
+}
+
+func executeStandingOrder(id int64, now time.Time) error {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return fmt.Errorf("transaction preparation failed")
+	}
+
+	// Re-read the order under lock, it may have been cancelled or run by now
+	order, err := lockStandingOrder(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if order.NextRun.After(now) {
+		_ = tx.Rollback()
+		return nil
+	}
+
+	// Move the funds and the order forward together
+	receipt, err := transferFunds(tx, order.Username, order.Username, order.Recipient, order.Amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return recordStandingOrderFailure(order, err, now)
+	}
+	if err := advanceStandingOrder(tx, order); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "standing_order", fmt.Sprintf("%s transferred %s to %s by standing order %d", order.Username, formatAmount(order.Amount, receipt.Currency), order.Recipient, order.ID))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	announceTransfer(order.Username, order.Recipient, receipt)
+	return nil
+}
+
+// recordStandingOrderFailure schedules a retry of the current occurrence or,
+// once the retries are used up, skips it and notifies the owner
+func recordStandingOrderFailure(order StandingOrder, cause error, now time.Time) error {
+	reason := "transfer failed"
+	var limitErr *LimitError
+	var statusErr *AccountStatusError
+	if errors.Is(cause, errInsufficientFunds) {
+		reason = "insufficient balance"
+	} else if errors.As(cause, &limitErr) {
+		reason = limitErr.Error()
+	} else if errors.Is(cause, errPayeeCoolingOff) {
+		reason = "new payee cooling-off period"
+	} else if errors.As(cause, &statusErr) {
+		reason = statusErr.Error()
+	}
+
+	retries := order.Retries + 1
+	if retries < standingOrderMaxRetries {
+		_, err := db.Exec("UPDATE standing_orders SET retries = ?, retry_at = ? WHERE id = ? AND occurrence = ?",
+			retries, now.Add(standingOrderRetryDelay), order.ID, order.Occurrence)
+		return err
+	}
+
+	// Skip this occurrence
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := advanceStandingOrder(tx, order); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	currency, err := getAccountCurrency(order.Username)
+	if err != nil {
+		return err
+	}
+	return notifyUser(order.Username, fmt.Sprintf("Standing order %d of %s to %s due %s failed after %d attempts: %s",
+		order.ID, formatAmount(order.Amount, currency), order.Recipient, order.NextRun.Format(dateLayout), retries, reason))
+}
+
+// Account Limits
+
+const errCodeLimitExceeded = "LIMIT_EXCEEDED"
+
+// AccountLimits holds the outflow caps of an account. A null field means
+// there is no cap.
+type AccountLimits struct {
+	MaxWithdrawal  sql.NullFloat64
+	DailyTransfer  sql.NullFloat64
+	MonthlyOutflow sql.NullFloat64
+}
+
+type LimitError struct {
+	Limit    string
+	Max      float64
+	Currency string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %s exceeded", e.Limit, formatAmount(e.Max, e.Currency))
+}
+
+// Response is the line sent to the client, prefixed with the error code
+func (e *LimitError) Response() string {
+	return fmt.Sprintf("%s: %s\n", errCodeLimitExceeded, e.Error())
+}
+
+// loadAccountLimits returns the limits of the account type, overridden field
+// by field by the limits set on the account itself
+func loadAccountLimits(tx *sql.Tx, username, accountType string) (AccountLimits, error) {
+	var limits AccountLimits
+	err := tx.QueryRow("SELECT max_withdrawal, daily_transfer, monthly_outflow FROM account_type_limits WHERE account_type = ?", accountType).
+		Scan(&limits.MaxWithdrawal, &limits.DailyTransfer, &limits.MonthlyOutflow)
+	if err != nil && err != sql.ErrNoRows {
+		return limits, err
+	}
+
+	var override AccountLimits
+	err = tx.QueryRow("SELECT max_withdrawal, daily_transfer, monthly_outflow FROM account_limits WHERE username = ?", username).
+		Scan(&override.MaxWithdrawal, &override.DailyTransfer, &override.MonthlyOutflow)
+	if err == sql.ErrNoRows {
+		return limits, nil
+	}
+	if err != nil {
+		return limits, err
+	}
+	if override.MaxWithdrawal.Valid {
+		limits.MaxWithdrawal = override.MaxWithdrawal
+	}
+	if override.DailyTransfer.Valid {
+		limits.DailyTransfer = override.DailyTransfer
+	}
+	if override.MonthlyOutflow.Valid {
+		limits.MonthlyOutflow = override.MonthlyOutflow
+	}
+	return limits, nil
+}
+
+// checkOutflowLimits verifies that moving amount out of the account by a
+// withdraw or transfer, plus the fee charged for it, stays within its limits.
+// Days and months are UTC calendar periods. It must run inside the same
+// transaction as the balance update, after the account row has been locked,
+// so concurrent operations cannot both pass the check.
+func checkOutflowLimits(tx *sql.Tx, username, accountType, currency, operation string, amount, fee float64) error {
+	limits, err := loadAccountLimits(tx, username, accountType)
+	if err != nil {
+		return err
+	}
+
+	if operation == "withdraw" && limits.MaxWithdrawal.Valid && amount > limits.MaxWithdrawal.Float64 {
+		return &LimitError{Limit: "Single withdrawal", Max: limits.MaxWithdrawal.Float64, Currency: currency}
+	}
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	if operation == "transfer" && limits.DailyTransfer.Valid {
+		var transferredToday float64
+		err := tx.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM transactions WHERE username = ? AND type = 'transfer_out' AND created_at >= ?", username, dayStart).
+			Scan(&transferredToday)
+		if err != nil {
+			return err
+		}
+		if transferredToday+amount > limits.DailyTransfer.Float64 {
+			return &LimitError{Limit: "Daily transfer", Max: limits.DailyTransfer.Float64, Currency: currency}
+		}
+	}
+
+	if limits.MonthlyOutflow.Valid {
+		var outflow float64
+		err := tx.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM transactions WHERE username = ? AND amount < 0 AND created_at >= ?", username, monthStart).
+			Scan(&outflow)
+		if err != nil {
+			return err
+		}
+		if outflow+amount+fee > limits.MonthlyOutflow.Float64 {
+			return &LimitError{Limit: "Monthly outflow", Max: limits.MonthlyOutflow.Float64, Currency: currency}
+		}
+	}
+
+	return nil
+}
+
+// Fees
+
+type FeeTier struct {
+	UpTo sql.NullFloat64 // Upper bound of the band, null for the last band
+	Fee  float64
+}
+
+type FeeRule struct {
+	ID              int64
+	Kind            string // flat, percentage or tiered
+	FlatAmount      float64
+	Percentage      float64
+	MinFee          sql.NullFloat64
+	MaxFee          sql.NullFloat64
+	WaiveForPremium bool
+	Tiers           []FeeTier
+}
+
+// Compute returns the fee for an amount, before rounding to the currency
+func (r FeeRule) Compute(amount float64) float64 {
+	var fee float64
+	switch r.Kind {
+	case "flat":
+		fee = r.FlatAmount
+	case "percentage":
+		fee = amount * r.Percentage / 100
+	case "tiered":
+		for _, tier := range r.Tiers {
+			if !tier.UpTo.Valid || amount <= tier.UpTo.Float64 {
+				fee = tier.Fee
+				break
+			}
+		}
+	}
+
+	if r.MinFee.Valid && fee < r.MinFee.Float64 {
+		fee = r.MinFee.Float64
+	}
+	if r.MaxFee.Valid && fee > r.MaxFee.Float64 {
+		fee = r.MaxFee.Float64
+	}
+	return fee
+}
+
+// findFeeRule returns the most specific rule for an operation: rules for the
+// account type win over generic ones, then rules for the currency
+func findFeeRule(tx *sql.Tx, operation, accountType, currency string) (FeeRule, bool, error) {
+	var rule FeeRule
+	err := tx.QueryRow(`SELECT id, kind, flat_amount, percentage, min_fee, max_fee, waive_for_premium FROM fee_rules
+		WHERE operation = ? AND (account_type IS NULL OR account_type = ?) AND (currency IS NULL OR currency = ?)
+		ORDER BY account_type IS NULL, currency IS NULL, id LIMIT 1`, operation, accountType, currency).
+		Scan(&rule.ID, &rule.Kind, &rule.FlatAmount, &rule.Percentage, &rule.MinFee, &rule.MaxFee, &rule.WaiveForPremium)
+	if err == sql.ErrNoRows {
+		return rule, false, nil
+	}
+	if err != nil {
+		return rule, false, err
+	}
+
+	if rule.Kind == "tiered" {
+		rows, err := tx.Query("SELECT up_to, fee FROM fee_tiers WHERE rule_id = ? ORDER BY up_to IS NULL, up_to", rule.ID)
+		if err != nil {
+			return rule, false, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tier FeeTier
+			if err := rows.Scan(&tier.UpTo, &tier.Fee); err != nil {
+				return rule, false, err
+			}
+			rule.Tiers = append(rule.Tiers, tier)
+		}
+		if err := rows.Err(); err != nil {
+			return rule, false, err
+		}
+	}
+	return rule, true, nil
+}
+
+// computeFee runs the fee rules for an operation on an account. Amounts in
+// rules are in the account's currency.
+func computeFee(tx *sql.Tx, operation, accountType, currency string, premium bool, amount float64) (float64, error) {
+	rule, ok, err := findFeeRule(tx, operation, accountType, currency)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if premium && rule.WaiveForPremium {
+		return 0, nil
+	}
+	return roundToMinorUnits(rule.Compute(amount), currency), nil
+}
+
+// bankAccountPrefix starts the name of every bank-owned account. Customers
+// cannot register names with it, so these accounts cannot be claimed.
+const bankAccountPrefix = "bank_"
+
+// revenueAccount is the bank-owned account that collects fees in a currency
+func revenueAccount(currency string) string {
+	return bankAccountPrefix + "revenue_" + strings.ToLower(currency)
+}
+
+// provisionBankAccounts creates the bank-owned accounts of every supported
+// currency at startup
+func provisionBankAccounts() error {
+	for code := range currencies {
+		if err := provisionBankAccount(revenueAccount(code), code, "revenue"); err != nil {
+			return err
+		}
+		if err := provisionBankAccount(loanAccount(code), code, "loan"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provisionBankAccount creates a bank-owned account if it does not exist and
+// checks that an existing one is the bank's, so a name registered by a
+// customer before it was reserved is reported instead of used
+func provisionBankAccount(name, currency, accountType string) error {
+	_, err := db.Exec("INSERT IGNORE INTO account (username, balance, currency, account_type) VALUES (?, 0, ?, ?)", name, currency, accountType)
+	if err != nil {
+		return err
+	}
+	var existingCurrency, existingType string
+	err = db.QueryRow("SELECT currency, account_type FROM account WHERE username = ?", name).Scan(&existingCurrency, &existingType)
+	if err != nil {
+		return err
+	}
+	if existingCurrency != currency || existingType != accountType {
+		return fmt.Errorf("account %s is a %s %s account, expected the bank's %s %s account", name, existingCurrency, existingType, currency, accountType)
+	}
+	owned, err := userExists(name)
+	if err != nil {
+		return err
+	}
+	if owned {
+		return fmt.Errorf("account %s is registered to a customer", name)
+	}
+	return nil
+}
+
+// creditBankAccount adds amount to a bank-owned account inside tx. The
+// account must have been provisioned, money is never sent to a missing one.
+func creditBankAccount(tx *sql.Tx, name string, amount float64) error {
+	var exists int
+	err := tx.QueryRow("SELECT 1 FROM account WHERE username = ? FOR UPDATE", name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("bank account %s is not provisioned", name)
+	}
+	if err != nil {
+		return err
+	}
+	return adjustBalance(tx, name, amount)
+}
+
+// postFee moves the fee from the payer to the bank revenue account inside tx,
+// linking both ledger entries to the operation that caused the fee
+func postFee(tx *sql.Tx, actor, username, currency string, fee float64, referenceID int64) error {
+	if fee <= 0 {
+		return nil
+	}
+	revenue := revenueAccount(currency)
+
+	err := adjustBalance(tx, username, -fee)
+	if err != nil {
+		return err
+	}
+	if err := creditBankAccount(tx, revenue, fee); err != nil {
+		return err
+	}
+
+	reference := sql.NullInt64{Int64: referenceID, Valid: true}
+	_, err = recordTransaction(tx, LedgerEntry{Username: username, Type: "fee", Amount: -fee, Currency: currency, Counterparty: revenue, ReferenceID: reference, InitiatedBy: actor})
+	if err != nil {
+		return err
+	}
+	_, err = recordTransaction(tx, LedgerEntry{Username: revenue, Type: "fee", Amount: fee, Currency: currency, Counterparty: username, ReferenceID: reference, InitiatedBy: actor})
+	return err
+}
+
+// Authorization Holds
+
+var (
+	expiryInterval  = time.Minute
+	maxHoldDuration = 30 * 24 * time.Hour
+)
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// heldAmount returns the total reserved by active, unexpired holds on an account
+func heldAmount(q queryRower, username string) (float64, error) {
+	var held float64
+	err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM holds WHERE username = ? AND status = 'active' AND expires_at > ?", username, time.Now().UTC()).Scan(&held)
+	return held, err
+}
+
+func handlePlaceHold(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read merchant, amount and validity in hours from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading hold", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	merchant, amountStr, hoursStr := fields[0], fields[1], fields[2]
+
+	// Validate merchant username
+	if merchant == username {
+		conn.Write([]byte("Self-hold not allowed.\n"))
+		return
+	}
+	exists, err := userExists(merchant)
+	if err != nil {
+		log.Error("error checking merchant", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte("Merchant not found\n"))
+		return
+	}
+
+	// Parse the amount in the account currency and the validity
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid hold amount\n"))
+		return
+	}
+	hours, err := strconv.Atoi(hoursStr)
+	validity := time.Duration(hours) * time.Hour
+	if err != nil || hours <= 0 || validity > maxHoldDuration {
+		conn.Write([]byte("Invalid hold validity\n"))
+		return
+	}
+
+	id, err := placeHold(username, merchant, amount, time.Now().UTC().Add(validity))
+	if errors.Is(err, errInsufficientFunds) {
+		conn.Write([]byte("Insufficient balance for hold.\n"))
+		return
+	}
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
+	if err != nil {
+		log.Error("error placing hold", "err", err)
+		conn.Write([]byte("Error placing hold\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Hold %d of %s for %s placed, valid for %d hours\n", id, formatAmount(amount, currency), merchant, hours)))
+}
+
+// placeHold reserves amount on the account for the merchant until expiresAt
+func placeHold(username, merchant string, amount float64, expiresAt time.Time) (int64, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock the account row so concurrent debits see the hold
+	var balance float64
+	var status string
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, username); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT balance, status FROM account WHERE username = ? FOR UPDATE", username).Scan(&balance, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := checkCanDebit(username, status); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Check if the available balance covers the hold
+	available, err := availableBalance(tx, username, balance)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if available < amount {
+		_ = tx.Rollback()
+		return 0, errInsufficientFunds
+	}
+
+	result, err := tx.Exec("INSERT INTO holds (username, merchant, amount, expires_at) VALUES (?, ?, ?, ?)", username, merchant, amount, expiresAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func handleListHolds(conn net.Conn, log *slog.Logger, username string) {
+	rows, err := db.Query("SELECT h.id, h.username, h.merchant, h.amount, a.currency, h.expires_at FROM holds h JOIN account a ON a.username = h.username WHERE (h.username = ? OR h.merchant = ?) AND h.status = 'active' AND h.expires_at > ? ORDER BY h.expires_at, h.id",
+		username, username, time.Now().UTC())
+	if err != nil {
+		log.Error("error querying holds", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var id int64
+		var holder, merchant, currency, expiresAt string
+		var amount float64
+		if err := rows.Scan(&id, &holder, &merchant, &amount, &currency, &expiresAt); err != nil {
+			log.Error("error reading hold", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if holder == username {
+			message += fmt.Sprintf("#%d: %s held for %s until %s\n", id, formatAmount(amount, currency), merchant, expiresAt)
+		} else {
+			message += fmt.Sprintf("#%d: %s authorized by %s until %s\n", id, formatAmount(amount, currency), holder, expiresAt)
+		}
+	}
+	if message == "" {
+		message = "No active holds\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleCaptureHold(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read hold ID and capture amount from client, an empty amount captures it in full
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading hold ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amountStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading capture amount", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid hold ID\n"))
+		return
+	}
+
+	receipt, err := captureHold(id, username, strings.TrimSpace(amountStr))
+	if errors.Is(err, errHoldNotFound) {
+		conn.Write([]byte("Hold not found\n"))
+		return
+	}
+	if errors.Is(err, errInvalidCapture) {
+		conn.Write([]byte("Invalid capture amount\n"))
+		return
+	}
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
+	if err != nil {
+		log.Error("error capturing hold", "err", err)
+		conn.Write([]byte("Error capturing hold\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Hold %d captured: %s received\n", id, formatAmount(receipt.CreditedAmount, receipt.CreditedCurrency))))
+}
+
+var (
+	errHoldNotFound   = errors.New("hold not found")
+	errInvalidCapture = errors.New("invalid capture amount")
+)
+
+// captureHold lets the merchant collect up to the held amount. The hold is
+// closed and any remainder released in the same transaction as the transfer.
+func captureHold(id int64, merchant, amountStr string) (TransferReceipt, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return TransferReceipt{}, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the hold, it must be active, unexpired and in favour of the merchant
+	var holder, currency string
+	var held float64
+	err = tx.QueryRow("SELECT h.username, h.amount, a.currency FROM holds h JOIN account a ON a.username = h.username WHERE h.id = ? AND h.merchant = ? AND h.status = 'active' AND h.expires_at > ? FOR UPDATE",
+		id, merchant, time.Now().UTC()).Scan(&holder, &held, &currency)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return TransferReceipt{}, errHoldNotFound
+		}
+		return TransferReceipt{}, err
+	}
+
+	amount := held
+	if amountStr != "" {
+		amount, err = parseAmount(amountStr, currency)
+		if err != nil || amount > held {
+			_ = tx.Rollback()
+			return TransferReceipt{}, errInvalidCapture
+		}
+	}
+
+	// Close the hold first so its reservation no longer counts against the transfer
+	_, err = tx.Exec("UPDATE holds SET status = 'captured', captured_amount = ? WHERE id = ?", amount, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	receipt, err := captureFunds(tx, holder, merchant, amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "capture", fmt.Sprintf("%s captured %s of hold %d from %s", merchant, formatAmount(amount, currency), id, holder))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return TransferReceipt{}, err
+	}
+
+	announceTransfer(holder, merchant, receipt)
+	return receipt, nil
+}
+
+// captureFunds moves exactly the captured amount from the holder to the
+// merchant. The hold already authorized it, so unlike transferFunds there is
+// no fee, and no limit or payee rule can refuse it.
+func captureFunds(tx *sql.Tx, holder, merchant string, amount float64) (TransferReceipt, error) {
+	var receipt TransferReceipt
+
+	// Lock both account rows and read the holder's balance
+	if err := lockAccountStream(tx, holder); err != nil {
+		return receipt, err
+	}
+	var holderBalance float64
+	var holderCurrency, holderStatus, merchantCurrency, merchantStatus string
+	err := tx.QueryRow("SELECT balance, currency, status FROM account WHERE username = ? FOR UPDATE", holder).Scan(&holderBalance, &holderCurrency, &holderStatus)
+	if err != nil {
+		return receipt, err
+	}
+	err = tx.QueryRow("SELECT currency, status FROM account WHERE username = ? FOR UPDATE", merchant).Scan(&merchantCurrency, &merchantStatus)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return receipt, errRecipientNotFound
+		}
+		return receipt, err
+	}
+	if err := checkCanDebit(holder, holderStatus); err != nil {
+		return receipt, err
+	}
+	if err := checkCanCredit(merchant, merchantStatus); err != nil {
+		return receipt, err
+	}
+
+	// The hold is already closed, so its reservation is available again
+	available, err := availableBalance(tx, holder, holderBalance)
+	if err != nil {
+		return receipt, err
+	}
+	if available < amount {
+		return receipt, errInsufficientFunds
+	}
+
+	receipt, err = postTransfer(tx, merchant, holder, merchant, holderCurrency, merchantCurrency, amount, 0)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.Available = available - amount
+	return receipt, nil
+}
+
+func handleReleaseHold(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read hold ID from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading hold ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid hold ID\n"))
+		return
+	}
+
+	// Only the merchant can release a hold before it expires
+	result, err := db.Exec("UPDATE holds SET status = 'released' WHERE id = ? AND merchant = ? AND status = 'active'", id, username)
+	if err != nil {
+		log.Error("error releasing hold", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		conn.Write([]byte("Hold not found\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Hold %d released\n", id)))
+}
+
+// startExpiryScheduler marks holds and payment requests past their expiry.
+// Both stop being usable as soon as expires_at passes, this only updates
+// their status.
+func startExpiryScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		now := time.Now().UTC()
+		_, err := db.Exec("UPDATE holds SET status = 'expired' WHERE status = 'active' AND expires_at <= ?", now)
+		if err != nil {
+			logger.Error("error expiring holds", "err", err)
+		}
+		_, err = db.Exec("UPDATE payment_requests SET status = 'expired' WHERE status = 'pending' AND expires_at <= ?", now)
+		if err != nil {
+			logger.Error("error expiring payment requests", "err", err)
+		}
+		finishOperation()
+		time.Sleep(expiryInterval)
+	}
+}
+
+// Reversals and Refunds
+
+var (
+	errNotReversible = errors.New("transaction cannot be reversed")
+	errInvalidRefund = errors.New("invalid refund amount")
+	errNotAuthorized = errors.New("not authorized")
+)
+
+func isAdmin(username string) (bool, error) {
+	var admin bool
+	err := db.QueryRow("SELECT is_admin FROM users WHERE username = ?", username).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+func handleReverseTransfer(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read the transfer reference and the refund amount, an empty amount refunds what is left
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading transfer reference", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amountStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading refund amount", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid transfer reference\n"))
+		return
+	}
+
+	admin, err := isAdmin(username)
+	if err != nil {
+		log.Error("error checking admin", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	reversal, err := reverseTransfer(id, strings.TrimSpace(amountStr), username, admin)
+	var statusErr *AccountStatusError
+	switch {
+	case errors.Is(err, errNotReversible):
+		conn.Write([]byte("Transfer not found or already reversed\n"))
+		return
+	case errors.Is(err, errNotAuthorized):
+		conn.Write([]byte("Only the recipient or an admin can reverse this transfer\n"))
+		return
+	case errors.Is(err, errInvalidRefund):
+		conn.Write([]byte("Invalid refund amount\n"))
+		return
+	case errors.Is(err, errInsufficientFunds):
+		conn.Write([]byte("Insufficient balance for refund.\n"))
+		return
+	case errors.As(err, &statusErr):
+		conn.Write([]byte(statusErr.Response()))
+		return
+	case err != nil:
+		log.Error("error reversing transfer", "err", err)
+		conn.Write([]byte("Error reversing transfer\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Transfer %d reversed: %s returned to %s (reference %d)\n", id, formatAmount(reversal.Amount, reversal.Currency), reversal.Sender, reversal.ID)))
+}
+
+type Reversal struct {
+	ID       int64 // Ledger entry crediting the original sender
+	Sender   string
+	Amount   float64 // Returned to the sender, in the sender's currency
+	Currency string
+}
+
+// reverseTransfer returns all or part of a transfer to its sender. The
+// recipient is debited at the rate of the original transfer and both entries
+// reference it. The amount already reversed is tracked on the original entry
+// under a row lock, so a transfer can never be refunded more than once in full.
+func reverseTransfer(id int64, amountStr, actor string, admin bool) (Reversal, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return Reversal{}, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return Reversal{}, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the sender's leg of the original transfer
+	var sender, recipient, senderCurrency string
+	var original, reversed float64
+	err = tx.QueryRow("SELECT username, counterparty, -amount, currency, reversed_amount FROM transactions WHERE id = ? AND type = 'transfer_out' FOR UPDATE", id).
+		Scan(&sender, &recipient, &original, &senderCurrency, &reversed)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return Reversal{}, errNotReversible
+		}
+		return Reversal{}, err
+	}
+	if !admin && actor != recipient {
+		_ = tx.Rollback()
+		return Reversal{}, errNotAuthorized
+	}
+
+	remaining := roundToMinorUnits(original-reversed, senderCurrency)
+	if remaining <= 0 {
+		_ = tx.Rollback()
+		return Reversal{}, errNotReversible
+	}
+	refund := remaining
+	if amountStr != "" {
+		refund, err = parseAmount(amountStr, senderCurrency)
+		if err != nil || refund > remaining {
+			_ = tx.Rollback()
+			return Reversal{}, errInvalidRefund
+		}
+	}
+
+	// Find the recipient's leg to debit the same share in their currency
+	var credited float64
+	var recipientCurrency string
+	err = tx.QueryRow("SELECT amount, currency FROM transactions WHERE reference_id = ? AND type = 'transfer_in'", id).Scan(&credited, &recipientCurrency)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	debit := roundToMinorUnits(credited*refund/original, recipientCurrency)
+	if refund == remaining {
+		// The last refund takes back whatever earlier rounded shares left,
+		// so all refunds together debit exactly the credited amount
+		var debited float64
+		err = tx.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM transactions WHERE reference_id = ? AND type = 'reversal_out'", id).Scan(&debited)
+		if err != nil {
+			_ = tx.Rollback()
+			return Reversal{}, err
+		}
+		debit = roundToMinorUnits(credited-debited, recipientCurrency)
+	}
+
+	// Lock both rows. Admins may reverse out of a frozen or dormant account,
+	// but nothing moves into or out of a closed one.
+	var senderStatus, recipientStatus string
+	err = tx.QueryRow("SELECT status FROM account WHERE username = ? FOR UPDATE", sender).Scan(&senderStatus)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	if err := checkCanCredit(sender, senderStatus); err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	var recipientBalance float64
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, recipient); err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	err = tx.QueryRow("SELECT balance, status FROM account WHERE username = ? FOR UPDATE", recipient).Scan(&recipientBalance, &recipientStatus)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	if recipientStatus == "closed" || (!admin && recipientStatus != "active") {
+		_ = tx.Rollback()
+		return Reversal{}, &AccountStatusError{Account: recipient, Status: recipientStatus}
+	}
+	available, err := availableBalance(tx, recipient, recipientBalance)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	if available < debit {
+		_ = tx.Rollback()
+		return Reversal{}, errInsufficientFunds
+	}
+
+	// Move the funds back
+	err = adjustBalance(tx, recipient, -debit)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	err = adjustBalance(tx, sender, refund)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+
+	// Record the compensating entries, both linked to the original transfer
+	reference := sql.NullInt64{Int64: id, Valid: true}
+	_, err = recordTransaction(tx, LedgerEntry{Username: recipient, Type: "reversal_out", Amount: -debit, Currency: recipientCurrency, Counterparty: sender, ReferenceID: reference, InitiatedBy: actor})
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	creditID, err := recordTransaction(tx, LedgerEntry{Username: sender, Type: "reversal_in", Amount: refund, Currency: senderCurrency, Counterparty: recipient, ReferenceID: reference, InitiatedBy: actor})
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+	_, err = tx.Exec("UPDATE transactions SET reversed_amount = reversed_amount + ? WHERE id = ?", refund, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return Reversal{}, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "reversal", fmt.Sprintf("%s reversed %s of transfer %d from %s to %s", actor, formatAmount(refund, senderCurrency), id, sender, recipient))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return Reversal{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return Reversal{}, err
+	}
+
+	// Let the sender know the money is back
+	message := fmt.Sprintf("Transfer %d to %s was reversed: %s returned", id, recipient, formatAmount(refund, senderCurrency))
+	if err := notifyUser(sender, message); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+
+	return Reversal{ID: creditID, Sender: sender, Amount: refund, Currency: senderCurrency}, nil
+}
+
+// Payment Requests
+
+var paymentRequestTTL = 7 * 24 * time.Hour // Overridden by BANK_PAYMENT_REQUEST_TTL
+
+var errRequestNotFound = errors.New("payment request not found")
+
+func handleRequestPayment(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read payer, amount and note from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading payment request", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	payer, amountStr, note := fields[0], fields[1], fields[2]
+
+	// Validate payer username
+	if payer == username {
+		conn.Write([]byte("Self-request not allowed.\n"))
+		return
+	}
+	exists, err := userExists(payer)
+	if err != nil {
+		log.Error("error checking payer", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte("Payer not found\n"))
+		return
+	}
+
+	// The amount is requested in the requester's currency
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid request amount\n"))
+		return
+	}
+	note = truncate(note, 255)
+
+	expiresAt := time.Now().UTC().Add(paymentRequestTTL)
+	result, err := db.Exec("INSERT INTO payment_requests (requester, payer, amount, currency, note, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		username, payer, amount, currency, note, expiresAt)
+	if err != nil {
+		log.Error("error inserting payment request", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error("error inserting payment request", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	if err := notifyUser(payer, fmt.Sprintf("%s requested %s from you (request %d)", username, formatAmount(amount, currency), id)); err != nil {
+		log.Error("error notifying user", "err", err)
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Payment request %d for %s sent to %s, expires %s\n", id, formatAmount(amount, currency), payer, expiresAt.Format("2006-01-02 15:04"))))
+}
+
+func handleListPaymentRequests(conn net.Conn, log *slog.Logger, username string) {
+	rows, err := db.Query("SELECT id, requester, payer, amount, currency, note, expires_at FROM payment_requests WHERE (payer = ? OR requester = ?) AND status = 'pending' AND expires_at > ? ORDER BY expires_at, id",
+		username, username, time.Now().UTC())
+	if err != nil {
+		log.Error("error querying payment requests", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var id int64
+		var requester, payer, currency, note, expiresAt string
+		var amount float64
+		if err := rows.Scan(&id, &requester, &payer, &amount, &currency, &note, &expiresAt); err != nil {
+			log.Error("error reading payment request", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if payer == username {
+			message += fmt.Sprintf("#%d: %s requests %s", id, requester, formatAmount(amount, currency))
+		} else {
+			message += fmt.Sprintf("#%d: you requested %s from %s", id, formatAmount(amount, currency), payer)
+		}
+		if note != "" {
+			message += fmt.Sprintf(" (%s)", note)
+		}
+		message += fmt.Sprintf(", expires %s\n", expiresAt)
+	}
+	if message == "" {
+		message = "No pending payment requests\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleRespondPaymentRequest(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read request ID and decision from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading payment request ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	decision, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading decision", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid payment request ID\n"))
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(decision)) {
+	case "accept":
+		receipt, err := acceptPaymentRequest(id, username)
+		switch {
+		case errors.Is(err, errRequestNotFound):
+			conn.Write([]byte("Payment request not found\n"))
+		case errors.Is(err, errInsufficientFunds):
+			conn.Write([]byte("Insufficient balance for transfer.\n"))
+		case err != nil:
+			var limitErr *LimitError
+			if errors.As(err, &limitErr) {
+				conn.Write([]byte(limitErr.Response()))
+				return
+			}
+			var statusErr *AccountStatusError
+			if errors.As(err, &statusErr) {
+				conn.Write([]byte(statusErr.Response()))
+				return
+			}
+			log.Error("error accepting payment request", "err", err)
+			conn.Write([]byte("Error transferring amount\n"))
+		default:
+			conn.Write([]byte(fmt.Sprintf("Payment request %d paid: %s transferred (reference %d)\n", id, formatAmount(receipt.Amount, receipt.Currency), receipt.ID)))
+		}
+
+	case "decline":
+		var requester string
+		err := db.QueryRow("SELECT requester FROM payment_requests WHERE id = ? AND payer = ? AND status = 'pending' AND expires_at > ?", id, username, time.Now().UTC()).Scan(&requester)
+		if err == sql.ErrNoRows {
+			conn.Write([]byte("Payment request not found\n"))
+			return
+		}
+		if err != nil {
+			log.Error("error querying payment request", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		result, err := db.Exec("UPDATE payment_requests SET status = 'declined' WHERE id = ? AND status = 'pending'", id)
+		if err != nil {
+			log.Error("error declining payment request", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			conn.Write([]byte("Payment request not found\n"))
+			return
+		}
+		if err := notifyUser(requester, fmt.Sprintf("%s declined your payment request %d", username, id)); err != nil {
+			log.Error("error notifying user", "err", err)
+		}
+		conn.Write([]byte(fmt.Sprintf("Payment request %d declined\n", id)))
+
+	default:
+		conn.Write([]byte("Invalid decision, use accept or decline\n"))
+	}
+}
+
+// acceptPaymentRequest pays a pending request in the same transaction that
+// marks it accepted, so a request can only be paid once
+func acceptPaymentRequest(id int64, payer string) (TransferReceipt, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return TransferReceipt{}, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the request, it must still be pending and addressed to the payer
+	var requester, requestCurrency string
+	var requested float64
+	err = tx.QueryRow("SELECT requester, amount, currency FROM payment_requests WHERE id = ? AND payer = ? AND status = 'pending' AND expires_at > ? FOR UPDATE",
+		id, payer, time.Now().UTC()).Scan(&requester, &requested, &requestCurrency)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return TransferReceipt{}, errRequestNotFound
+		}
+		return TransferReceipt{}, err
+	}
+
+	// Express the requested amount in the payer's currency
+	var payerCurrency string
+	err = tx.QueryRow("SELECT currency FROM account WHERE username = ?", payer).Scan(&payerCurrency)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	rate, err := rateTable.Rate(requestCurrency, payerCurrency)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	amount := roundToMinorUnits(requested*rate, payerCurrency)
+
+	receipt, err := transferFunds(tx, payer, payer, requester, amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	_, err = tx.Exec("UPDATE payment_requests SET status = 'accepted', transaction_id = ? WHERE id = ?", receipt.ID, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "payment_request", fmt.Sprintf("%s paid request %d of %s from %s", payer, id, formatAmount(requested, requestCurrency), requester))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return TransferReceipt{}, err
+	}
+
+	if err := notifyUser(requester, fmt.Sprintf("%s paid your request %d: %s received", payer, id, formatAmount(receipt.CreditedAmount, receipt.CreditedCurrency))); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+	checkLowBalance(payer, receipt.Available+receipt.Amount+receipt.Fee, receipt.Available, receipt.Currency)
+	return receipt, nil
+}
+
+// Saved Payees
+
+var (
+	payeeCoolingOff        = 24 * time.Hour
+	largeTransferThreshold = 1000.0 // In defaultCurrency, converted into the sender's
+)
+
+var errPayeeCoolingOff = errors.New("payee is in its cooling-off period")
+
+// resolvePayee maps a saved payee nickname to its username. Anything that is
+// not a nickname of the owner is returned unchanged.
+func resolvePayee(owner, name string) (string, error) {
+	var payee string
+	err := db.QueryRow("SELECT payee FROM payees WHERE owner = ? AND nickname = ?", owner, name).Scan(&payee)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return payee, nil
+}
+
+// checkPayeeRules applies the per-payee limit and the cooling-off period of a
+// saved payee to a transfer. Recipients that are not saved payees pass.
+func checkPayeeRules(tx *sql.Tx, owner, payee, currency string, amount float64) error {
+	var maxAmount sql.NullFloat64
+	var coolingOff bool
+	err := tx.QueryRow("SELECT max_amount, created_at > NOW() - INTERVAL ? SECOND FROM payees WHERE owner = ? AND payee = ?",
+		int64(payeeCoolingOff/time.Second), owner, payee).Scan(&maxAmount, &coolingOff)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if maxAmount.Valid && amount > maxAmount.Float64 {
+		return &LimitError{Limit: "Payee", Max: maxAmount.Float64, Currency: currency}
+	}
+	if coolingOff {
+		threshold, err := largeTransferLimit(currency)
+		if err != nil {
+			return err
+		}
+		if amount > threshold {
+			return errPayeeCoolingOff
+		}
+	}
+	return nil
+}
+
+// largeTransferLimit converts largeTransferThreshold into currency with the
+// rate table
+func largeTransferLimit(currency string) (float64, error) {
+	rate, err := rateTable.Rate(defaultCurrency, currency)
+	if err != nil {
+		return 0, err
+	}
+	return roundToMinorUnits(largeTransferThreshold*rate, currency), nil
+}
+
+// formatLargeTransferLimit shows the threshold in currency, or in
+// defaultCurrency when there is no rate to convert it
+func formatLargeTransferLimit(currency string) string {
+	threshold, err := largeTransferLimit(currency)
+	if err != nil {
+		return formatAmount(largeTransferThreshold, defaultCurrency)
+	}
+	return formatAmount(threshold, currency)
+}
+
+func handleAddPayee(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read payee username, nickname and optional limit from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading payee", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	payee, nickname, limitStr := fields[0], fields[1], fields[2]
+
+	// Validate payee username and nickname
+	if payee == username {
+		conn.Write([]byte("Cannot add yourself as a payee\n"))
+		return
+	}
+	exists, err := userExists(payee)
+	if err != nil {
+		log.Error("error checking payee", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte("Payee not found\n"))
+		return
+	}
+	if nickname == "" {
+		nickname = payee
+	}
+
+	// Parse the optional per-payee limit in the owner's currency
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	var maxAmount sql.NullFloat64
+	if limitStr != "" {
+		maxAmount.Float64, err = parseAmount(limitStr, currency)
+		if err != nil {
+			conn.Write([]byte("Invalid payee limit\n"))
+			return
+		}
+		maxAmount.Valid = true
+	}
+
+	_, err = db.Exec("INSERT INTO payees (owner, payee, nickname, max_amount) VALUES (?, ?, ?, ?)", username, payee, nickname, maxAmount)
+	if err != nil {
+		// The unique keys reject a payee or nickname that is already saved
+		log.Error("error inserting payee", "err", err)
+		conn.Write([]byte("Payee or nickname already saved\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Payee %s saved as %s. Transfers above %s are allowed after %s\n", payee, nickname, formatLargeTransferLimit(currency), payeeCoolingOff)))
+}
+
+func handleListPayees(conn net.Conn, log *slog.Logger, username string) {
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	rows, err := db.Query("SELECT payee, nickname, max_amount, created_at > NOW() - INTERVAL ? SECOND FROM payees WHERE owner = ? ORDER BY nickname",
+		int64(payeeCoolingOff/time.Second), username)
+	if err != nil {
+		log.Error("error querying payees", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var payee, nickname string
+		var maxAmount sql.NullFloat64
+		var coolingOff bool
+		if err := rows.Scan(&payee, &nickname, &maxAmount, &coolingOff); err != nil {
+			log.Error("error reading payee", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("%s: %s", nickname, payee)
+		if maxAmount.Valid {
+			message += ", limit " + formatAmount(maxAmount.Float64, currency)
+		}
+		if coolingOff {
+			message += ", cooling off"
+		}
+		message += "\n"
+	}
+	if message == "" {
+		message = "No saved payees\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleRemovePayee(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read payee nickname from client
+	nickname, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading payee nickname", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	nickname = strings.TrimSpace(nickname)
+
+	result, err := db.Exec("DELETE FROM payees WHERE owner = ? AND nickname = ?", username, nickname)
+	if err != nil {
+		log.Error("error removing payee", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		conn.Write([]byte("Payee not found\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("Payee %s removed\n", nickname)))
+}
+
+// Joint Accounts
+
+// JointPermissions are the rights of one owner on a joint account
+type JointPermissions struct {
+	View     bool
+	Deposit  bool
+	Withdraw bool
+	Transfer bool
+	Manage   bool
+}
+
+func (p JointPermissions) String() string {
+	var names []string
+	for _, permission := range []struct {
+		name    string
+		granted bool
+	}{{"view", p.View}, {"deposit", p.Deposit}, {"withdraw", p.Withdraw}, {"transfer", p.Transfer}, {"manage", p.Manage}} {
+		if permission.granted {
+			names = append(names, permission.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// parseJointPermissions reads a comma separated list such as "view,deposit"
+func parseJointPermissions(list string) (JointPermissions, error) {
+	var p JointPermissions
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "view":
+			p.View = true
+		case "deposit":
+			p.Deposit = true
+		case "withdraw":
+			p.Withdraw = true
+		case "transfer":
+			p.Transfer = true
+		case "manage":
+			p.Manage = true
+		default:
+			return p, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return p, nil
+}
+
+// jointAccountKey is the account table key of a joint account
+func jointAccountKey(name string) string {
+	return "joint:" + name
+}
+
+func getJointPermissions(account, username string) (JointPermissions, bool, error) {
+	var p JointPermissions
+	err := db.QueryRow("SELECT can_view, can_deposit, can_withdraw, can_transfer, can_manage FROM account_owners WHERE account = ? AND username = ?", account, username).
+		Scan(&p.View, &p.Deposit, &p.Withdraw, &p.Transfer, &p.Manage)
+	if err == sql.ErrNoRows {
+		return p, false, nil
+	}
+	return p, err == nil, err
+}
+
+func handleCreateJointAccount(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read name, co-owners and approval threshold from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading joint account", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	name, coOwnersStr, thresholdStr := fields[0], fields[1], fields[2]
+
+	if name == "" || strings.ContainsAny(name, ": ") {
+		conn.Write([]byte("Invalid joint account name\n"))
+		return
+	}
+
+	// Validate co-owners
+	var coOwners []string
+	for _, owner := range strings.Split(coOwnersStr, ",") {
+		owner = strings.TrimSpace(owner)
+		if owner == "" || owner == username {
+			continue
+		}
+		exists, err := userExists(owner)
+		if err != nil {
+			log.Error("error checking co-owner", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if !exists {
+			conn.Write([]byte(fmt.Sprintf("Co-owner %s not found\n", owner)))
+			return
+		}
+		coOwners = append(coOwners, owner)
+	}
+
+	// The joint account uses the creator's currency
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	var threshold sql.NullFloat64
+	if thresholdStr != "" {
+		threshold.Float64, err = parseAmount(thresholdStr, currency)
+		if err != nil {
+			conn.Write([]byte("Invalid approval threshold\n"))
+			return
+		}
+		threshold.Valid = true
+	}
+
+	account := jointAccountKey(name)
+	if err := createJointAccount(account, username, currency, coOwners, threshold); err != nil {
+		log.Error("error creating joint account", "err", err)
+		conn.Write([]byte("Joint account name already taken\n"))
+		return
+	}
+
+	message := fmt.Sprintf("Joint account %s created in %s", account, currency)
+	if threshold.Valid {
+		message += fmt.Sprintf(", transfers above %s need a second owner's approval", formatAmount(threshold.Float64, currency))
+	}
+	conn.Write([]byte(message + "\n"))
+}
+
+// createJointAccount inserts the account and its owners in one transaction.
+// The creator gets every permission, co-owners all but manage.
+func createJointAccount(account, creator, currency string, coOwners []string, threshold sql.NullFloat64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO account (username, balance, currency, account_type) VALUES (?, 0, ?, 'joint')", account, currency)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO joint_accounts (account, approval_threshold, created_by) VALUES (?, ?, ?)", account, threshold, creator)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO account_owners (account, username, can_view, can_deposit, can_withdraw, can_transfer, can_manage) VALUES (?, ?, TRUE, TRUE, TRUE, TRUE, TRUE)", account, creator)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, owner := range coOwners {
+		_, err = tx.Exec("INSERT INTO account_owners (account, username, can_view, can_deposit, can_withdraw, can_transfer, can_manage) VALUES (?, ?, TRUE, TRUE, TRUE, TRUE, FALSE)", account, owner)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func handleSetJointPermissions(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read account, owner and permissions from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading joint permissions", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	account, owner, permissionsStr := jointAccountKey(fields[0]), fields[1], fields[2]
+
+	// Only owners with the manage permission can change permissions
+	p, ok, err := getJointPermissions(account, username)
+	if err != nil {
+		log.Error("error getting joint permissions", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !ok || !p.Manage {
+		conn.Write([]byte("Permission denied\n"))
+		return
+	}
+
+	permissions, err := parseJointPermissions(permissionsStr)
+	if err != nil {
+		conn.Write([]byte("Invalid permissions, use view,deposit,withdraw,transfer,manage\n"))
+		return
+	}
+	if owner == username && !permissions.Manage {
+		conn.Write([]byte("You cannot remove your own manage permission\n"))
+		return
+	}
+
+	// An empty list removes the owner
+	if permissionsStr == "" {
+		_, err = db.Exec("DELETE FROM account_owners WHERE account = ? AND username = ?", account, owner)
+		if err != nil {
+			log.Error("error removing owner", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("%s removed from %s\n", owner, account)))
+		return
+	}
+
+	exists, err := userExists(owner)
+	if err != nil {
+		log.Error("error checking owner", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !exists {
+		conn.Write([]byte("Owner not found\n"))
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO account_owners (account, username, can_view, can_deposit, can_withdraw, can_transfer, can_manage) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE can_view = VALUES(can_view), can_deposit = VALUES(can_deposit), can_withdraw = VALUES(can_withdraw), can_transfer = VALUES(can_transfer), can_manage = VALUES(can_manage)`,
+		account, owner, permissions.View, permissions.Deposit, permissions.Withdraw, permissions.Transfer, permissions.Manage)
+	if err != nil {
+		log.Error("error setting permissions", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("%s on %s: %s\n", owner, account, permissions)))
+}
+
+func handleListJointAccounts(conn net.Conn, log *slog.Logger, username string) {
+	rows, err := db.Query("SELECT account, can_view, can_deposit, can_withdraw, can_transfer, can_manage FROM account_owners WHERE username = ? ORDER BY account", username)
+	if err != nil {
+		log.Error("error querying joint accounts", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	type ownership struct {
+		account     string
+		permissions JointPermissions
+	}
+	var owned []ownership
+	for rows.Next() {
+		var o ownership
+		if err := rows.Scan(&o.account, &o.permissions.View, &o.permissions.Deposit, &o.permissions.Withdraw, &o.permissions.Transfer, &o.permissions.Manage); err != nil {
+			rows.Close()
+			log.Error("error reading joint account", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		owned = append(owned, o)
+	}
+	rows.Close()
+
+	var message string
+	for _, o := range owned {
+		message += fmt.Sprintf("%s [%s]", o.account, o.permissions)
+		if o.permissions.View {
+			balance, err := getBalance(o.account)
+			if err != nil {
+				log.Error("error getting current balance", "err", err)
+				conn.Write([]byte("Error getting current balance\n"))
+				return
+			}
+			message += ": " + balance.String()
+		}
+		message += "\n"
+
+		if !o.permissions.Transfer {
+			continue
+		}
+		pending, err := listPendingJointTransfers(o.account)
+		if err != nil {
+			log.Error("error querying joint approvals", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		for _, line := range pending {
+			message += "  " + line + "\n"
+		}
+	}
+	if message == "" {
+		message = "No joint accounts\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func listPendingJointTransfers(account string) ([]string, error) {
+	rows, err := db.Query("SELECT j.id, j.requested_by, j.recipient, j.amount, a.currency FROM joint_approvals j JOIN account a ON a.username = j.account WHERE j.account = ? AND j.status = 'pending' ORDER BY j.id", account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var id int64
+		var requestedBy, recipient, currency string
+		var amount float64
+		if err := rows.Scan(&id, &requestedBy, &recipient, &amount, &currency); err != nil {
+			return nil, err
+		}
+		lines = append(lines, fmt.Sprintf("pending #%d: %s wants to transfer %s to %s", id, requestedBy, formatAmount(amount, currency), recipient))
+	}
+	return lines, rows.Err()
+}
+
+func handleJointOperation(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read account, operation, amount and recipient (transfers only) from client
+	fields := make([]string, 4)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading joint operation", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	account, operation, amountStr, recipient := jointAccountKey(fields[0]), strings.ToLower(fields[1]), fields[2], fields[3]
+
+	p, ok, err := getJointPermissions(account, username)
+	if err != nil {
+		log.Error("error getting joint permissions", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !ok {
+		conn.Write([]byte("Joint account not found\n"))
+		return
+	}
+
+	currency, err := getAccountCurrency(account)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid amount\n"))
+		return
+	}
+
+	switch operation {
+	case "deposit":
+		if !p.Deposit {
+			conn.Write([]byte("Permission denied\n"))
+			return
+		}
+		err := depositAmountWithTwoPhaseCommit(username, account, amount)
+		var statusErr *AccountStatusError
+		if errors.As(err, &statusErr) {
+			conn.Write([]byte(statusErr.Response()))
+			return
+		}
+		if err != nil {
+			log.Error("error depositing amount", "err", err)
+			conn.Write([]byte("Error depositing amount\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("Deposit of %s to %s successful\n", formatAmount(amount, currency), account)))
+
+	case "withdraw":
+		if !p.Withdraw {
+			conn.Write([]byte("Permission denied\n"))
+			return
+		}
+		fee, err := withdrawAmountWithTwoPhaseCommit(username, account, amount)
+		var limitErr *LimitError
+		var statusErr *AccountStatusError
+		switch {
+		case errors.Is(err, errInsufficientFunds):
+			conn.Write([]byte("Insufficient balance\n"))
+		case errors.As(err, &limitErr):
+			conn.Write([]byte(limitErr.Response()))
+		case errors.As(err, &statusErr):
+			conn.Write([]byte(statusErr.Response()))
+		case err != nil:
+			log.Error("error withdrawing amount", "err", err)
+			conn.Write([]byte("Error withdrawing amount\n"))
+		default:
+			message := fmt.Sprintf("Withdrawal of %s from %s successful.", formatAmount(amount, currency), account)
+			if fee > 0 {
+				message += fmt.Sprintf(" Fee charged: %s.", formatAmount(fee, currency))
+			}
+			conn.Write([]byte(message + "\n"))
+		}
+
+	case "transfer":
+		if !p.Transfer {
+			conn.Write([]byte("Permission denied\n"))
+			return
+		}
+		recipient, err = resolvePayee(username, recipient)
+		if err != nil {
+			log.Error("error resolving payee", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if recipient == account || recipient == "" {
+			conn.Write([]byte("Invalid recipient\n"))
+			return
+		}
+
+		// Transfers above the threshold wait for a second owner
+		var threshold sql.NullFloat64
+		err = db.QueryRow("SELECT approval_threshold FROM joint_accounts WHERE account = ?", account).Scan(&threshold)
+		if err != nil {
+			log.Error("error getting approval threshold", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if threshold.Valid && amount > threshold.Float64 {
+			result, err := db.Exec("INSERT INTO joint_approvals (account, requested_by, recipient, amount) VALUES (?, ?, ?, ?)", account, username, recipient, amount)
+			if err != nil {
+				log.Error("error inserting joint approval", "err", err)
+				conn.Write([]byte("Internal server error\n"))
+				return
+			}
+			id, _ := result.LastInsertId()
+			conn.Write([]byte(fmt.Sprintf("Transfer of %s to %s is pending approval by another owner (request %d)\n", formatAmount(amount, currency), recipient, id)))
+			return
+		}
+
+		receipt, err := transferAmountWithTwoPhaseCommit(username, account, recipient, amount)
+		conn.Write([]byte(jointTransferResponse(receipt, recipient, err)))
+
+	default:
+		conn.Write([]byte("Invalid operation, use deposit, withdraw or transfer\n"))
+	}
+}
+
+func jointTransferResponse(receipt TransferReceipt, recipient string, err error) string {
+	var limitErr *LimitError
+	var statusErr *AccountStatusError
+	switch {
+	case errors.Is(err, errInsufficientFunds):
+		return "Insufficient balance for transfer.\n"
+	case errors.Is(err, errRecipientNotFound):
+		return "Recipient not found\n"
+	case errors.Is(err, errPayeeCoolingOff):
+		return "New payee: large transfers are allowed once the cooling-off period has passed\n"
+	case errors.As(err, &limitErr):
+		return limitErr.Response()
+	case errors.As(err, &statusErr):
+		return statusErr.Response()
+	case err != nil:
+		logger.Error("error transferring amount", "err", err)
+		return "Error transferring amount\n"
+	}
+	return fmt.Sprintf("Transfer of %s to %s successful (reference %d)\n", formatAmount(receipt.Amount, receipt.Currency), recipient, receipt.ID)
+}
+
+var errApprovalNotFound = errors.New("joint approval not found")
+
+func handleApproveJointTransfer(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read approval ID and decision from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading approval ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	decision, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading decision", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid approval ID\n"))
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(decision)) {
+	case "approve":
+		receipt, recipient, err := approveJointTransfer(id, username)
+		if errors.Is(err, errApprovalNotFound) {
+			conn.Write([]byte("Pending transfer not found\n"))
+			return
+		}
+		conn.Write([]byte(jointTransferResponse(receipt, recipient, err)))
+
+	case "reject":
+		result, err := db.Exec(`UPDATE joint_approvals j JOIN account_owners o ON o.account = j.account AND o.username = ? AND o.can_transfer
+			SET j.status = 'rejected', j.decided_by = ? WHERE j.id = ? AND j.status = 'pending'`, username, username, id)
+		if err != nil {
+			log.Error("error rejecting joint transfer", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			conn.Write([]byte("Pending transfer not found\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("Pending transfer %d rejected\n", id)))
+
+	default:
+		conn.Write([]byte("Invalid decision, use approve or reject\n"))
+	}
+}
+
+// approveJointTransfer executes a pending transfer once an owner other than
+// the requester approves it. The transfer and the status change share one
+// transaction, so a pending transfer is executed at most once.
+func approveJointTransfer(id int64, approver string) (TransferReceipt, string, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return TransferReceipt{}, "", err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, "", fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the pending transfer, the approver must be another owner allowed to transfer
+	var account, requestedBy, recipient string
+	var amount float64
+	err = tx.QueryRow(`SELECT j.account, j.requested_by, j.recipient, j.amount FROM joint_approvals j
+		JOIN account_owners o ON o.account = j.account AND o.username = ? AND o.can_transfer
+		WHERE j.id = ? AND j.status = 'pending' AND j.requested_by <> ? FOR UPDATE`, approver, id, approver).
+		Scan(&account, &requestedBy, &recipient, &amount)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return TransferReceipt{}, "", errApprovalNotFound
+		}
+		return TransferReceipt{}, "", err
+	}
+
+	// The requester initiated the transfer and resolved its payee, so their
+	// payee rules apply and they are audited as its actor
+	receipt, err := transferFunds(tx, requestedBy, account, recipient, amount)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, recipient, err
+	}
+	_, err = tx.Exec("UPDATE joint_approvals SET status = 'approved', decided_by = ?, transaction_id = ? WHERE id = ?", approver, receipt.ID, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, recipient, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "transfer", fmt.Sprintf("%s transferred %s to %s, requested by %s and approved by %s", account, formatAmount(amount, receipt.Currency), recipient, requestedBy, approver))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, recipient, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return TransferReceipt{}, recipient, err
+	}
+
+	if err := notifyUser(requestedBy, fmt.Sprintf("%s approved your transfer of %s from %s to %s", approver, formatAmount(amount, receipt.Currency), account, recipient)); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+	announceTransfer(account, recipient, receipt)
+	return receipt, recipient, nil
+}
+
+// Account Lifecycle
+
+const errCodeAccountInactive = "ACCOUNT_INACTIVE"
+
+// AccountStatusError reports an operation refused because of the status of
+// one of the accounts involved
+type AccountStatusError struct {
+	Account string
+	Status  string
+}
+
+func (e *AccountStatusError) Error() string {
+	return fmt.Sprintf("account %s is %s", e.Account, e.Status)
+}
+
+// Response is the line sent to the client, prefixed with the error code
+func (e *AccountStatusError) Response() string {
+	return fmt.Sprintf("%s: %s\n", errCodeAccountInactive, e.Error())
+}
+
+// checkCanDebit allows money out of active accounts only
+func checkCanDebit(account, status string) error {
+	if status != "active" {
+		return &AccountStatusError{Account: account, Status: status}
+	}
+	return nil
+}
+
+// checkCanCredit allows money into active and dormant accounts
+func checkCanCredit(account, status string) error {
+	if status != "active" && status != "dormant" {
+		return &AccountStatusError{Account: account, Status: status}
+	}
+	return nil
+}
+
+func getAccountStatus(account string) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM account WHERE username = ?", account).Scan(&status)
+	return status, err
+}
+
+// recordStatusChange keeps the history of every status change with its reason
+func recordStatusChange(tx *sql.Tx, account, status, reason, changedBy string) error {
+	_, err := tx.Exec("UPDATE account SET status = ? WHERE username = ?", status, account)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO account_status_history (account, status, reason, changed_by) VALUES (?, ?, ?, ?)", account, status, reason, changedBy)
+	return err
+}
+
+func handleSetAccountStatus(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read account, new status and reason from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading account status", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	account, status, reason := fields[0], strings.ToLower(fields[1]), fields[2]
+
+	admin, err := isAdmin(username)
+	if err != nil {
+		log.Error("error checking admin", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !admin {
+		auditConnAccount(conn, log, username, "status_change", account, "denied", "not an admin")
+		conn.Write([]byte("Permission denied\n"))
+		return
+	}
+
+	// Closing goes through its own flow because of the remaining balance
+	if status != "active" && status != "frozen" && status != "dormant" {
+		conn.Write([]byte("Invalid status, use active, frozen or dormant\n"))
+		return
+	}
+	if reason == "" {
+		conn.Write([]byte("A reason is required\n"))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("error starting transaction", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	var current string
+	err = tx.QueryRow("SELECT status FROM account WHERE username = ? FOR UPDATE", account).Scan(&current)
+	if err == sql.ErrNoRows || current == "closed" {
+		_ = tx.Rollback()
+		conn.Write([]byte("Account not found or closed\n"))
+		return
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.Error("error getting account status", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if err := recordStatusChange(tx, account, status, reason, username); err != nil {
+		_ = tx.Rollback()
+		log.Error("error changing account status", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("error changing account status", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	auditConnAccount(conn, log, username, "status_change", account, "success", fmt.Sprintf("%s to %s: %s", current, status, reason))
+
+	if err := notifyUser(account, fmt.Sprintf("Your account is now %s: %s", status, reason)); err != nil {
+		log.Error("error notifying user", "err", err)
+	}
+	conn.Write([]byte(fmt.Sprintf("Account %s changed from %s to %s\n", account, current, status)))
+}
+
+var (
+	errBalanceNotZero = errors.New("balance is not zero")
+	errActiveHolds    = errors.New("account has active holds")
+	errActiveLoans    = errors.New("account has active loans")
+)
+
+// handleCloseAccount closes the user's own account, or any account for an
+// admin. It reports whether the session's own account was closed.
+func handleCloseAccount(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) bool {
+	// Read account (empty for your own), sweep target and reason from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading close request", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return false
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	account, sweepTo, reason := fields[0], fields[1], fields[2]
+	if account == "" {
+		account = username
+	}
+	if reason == "" {
+		reason = "closed by customer"
+	}
+
+	admin, err := isAdmin(username)
+	if err != nil {
+		log.Error("error checking admin", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return false
+	}
+	if account != username && !admin {
+		auditConnAccount(conn, log, username, "close_account", account, "denied", "not an admin")
+		conn.Write([]byte("Permission denied\n"))
+		return false
+	}
+	if sweepTo == account {
+		conn.Write([]byte("Cannot sweep an account into itself\n"))
+		return false
+	}
+
+	swept, err := closeAccount(account, sweepTo, reason, username, admin)
+	detail := reason
+	if sweepTo != "" {
+		detail += ", sweep to " + sweepTo
+	}
+	auditConnAccount(conn, log, username, "close_account", account, auditOutcome(err), detail)
+	var statusErr *AccountStatusError
+	var limitErr *LimitError
+	switch {
+	case errors.Is(err, errBalanceNotZero):
+		conn.Write([]byte("Balance must be zero, or give an account to sweep the funds to\n"))
+		return false
+	case errors.Is(err, errActiveHolds):
+		conn.Write([]byte("Account has active holds\n"))
+		return false
+	case errors.Is(err, errActiveLoans):
+		conn.Write([]byte("Account has loans that are not paid off\n"))
+		return false
+	case errors.Is(err, errRecipientNotFound):
+		conn.Write([]byte("Sweep account not found\n"))
+		return false
+	case errors.As(err, &statusErr):
+		conn.Write([]byte(statusErr.Response()))
+		return false
+	case errors.As(err, &limitErr):
+		conn.Write([]byte(limitErr.Response()))
+		return false
+	case errors.Is(err, errPayeeCoolingOff):
+		conn.Write([]byte(fmt.Sprintf("New payee: sweeps above %s are allowed once the %s cooling-off period has passed\n", formatLargeTransferLimit(swept.Currency), payeeCoolingOff)))
+		return false
+	case err != nil:
+		log.Error("error closing account", "err", err)
+		conn.Write([]byte("Error closing account\n"))
+		return false
+	}
+
+	message := fmt.Sprintf("Account %s closed", account)
+	if swept.Amount > 0 {
+		message += fmt.Sprintf(", %s swept to %s", formatAmount(swept.Amount, swept.Currency), sweepTo)
+	}
+	conn.Write([]byte(message + "\n"))
+	return account == username
+}
+
+// closeAccount moves any remaining balance to sweepTo, cancels standing
+// orders and marks the account closed, all in one transaction. Sweeps carry
+// no fee. A customer closing their own account must be allowed to debit it,
+// and their sweep is subject to the transfer limits and payee rules; an admin
+// closing an account is not.
+func closeAccount(account, sweepTo, reason, closedBy string, admin bool) (TransferReceipt, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return TransferReceipt{}, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction preparation failed")
+	}
+
+	var balance float64
+	var currency, accountType, status string
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, account); err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	err = tx.QueryRow("SELECT balance, currency, account_type, status FROM account WHERE username = ? FOR UPDATE", account).Scan(&balance, &currency, &accountType, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	if status == "closed" {
+		_ = tx.Rollback()
+		return TransferReceipt{}, &AccountStatusError{Account: account, Status: status}
+	}
+	// A frozen or dormant customer cannot move their money out by closing
+	if !admin {
+		if err := checkCanDebit(account, status); err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+	}
+
+	held, err := heldAmount(tx, account)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	if held > 0 {
+		_ = tx.Rollback()
+		return TransferReceipt{}, errActiveHolds
+	}
+	var loans int
+	err = tx.QueryRow("SELECT COUNT(*) FROM loans WHERE username = ? AND status = 'active'", account).Scan(&loans)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	if loans > 0 {
+		_ = tx.Rollback()
+		return TransferReceipt{}, errActiveLoans
+	}
+
+	var receipt TransferReceipt
+	if balance < 0 || (balance > 0 && sweepTo == "") {
+		_ = tx.Rollback()
+		return TransferReceipt{}, errBalanceNotZero
+	}
+	if balance > 0 {
+		var targetCurrency, targetStatus string
+		err = tx.QueryRow("SELECT currency, status FROM account WHERE username = ? FOR UPDATE", sweepTo).Scan(&targetCurrency, &targetStatus)
+		if err != nil {
+			_ = tx.Rollback()
+			if err == sql.ErrNoRows {
+				return TransferReceipt{}, errRecipientNotFound
+			}
+			return TransferReceipt{}, err
+		}
+		if err := checkCanCredit(sweepTo, targetStatus); err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+		if !admin {
+			if err := checkOutflowLimits(tx, account, accountType, currency, "transfer", balance, 0); err != nil {
+				_ = tx.Rollback()
+				return TransferReceipt{Currency: currency}, err
+			}
+			if err := checkPayeeRules(tx, account, sweepTo, currency, balance); err != nil {
+				_ = tx.Rollback()
+				return TransferReceipt{Currency: currency}, err
+			}
+		}
+
+		rate, err := rateTable.Rate(currency, targetCurrency)
+		if err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+		credited := roundToMinorUnits(balance*rate, targetCurrency)
+
+		err = adjustBalance(tx, account, -balance)
+		if err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+		err = adjustBalance(tx, sweepTo, credited)
+		if err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+
+		fxRate := sql.NullFloat64{Float64: rate, Valid: currency != targetCurrency}
+		sweepID, err := recordTransaction(tx, LedgerEntry{Username: account, Type: "close_sweep_out", Amount: -balance, Currency: currency, Counterparty: sweepTo, FXRate: fxRate, InitiatedBy: closedBy})
+		if err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+		_, err = recordTransaction(tx, LedgerEntry{Username: sweepTo, Type: "close_sweep_in", Amount: credited, Currency: targetCurrency, Counterparty: account, FXRate: fxRate, ReferenceID: sql.NullInt64{Int64: sweepID, Valid: true}, InitiatedBy: closedBy})
+		if err != nil {
+			_ = tx.Rollback()
+			return TransferReceipt{}, err
+		}
+		receipt = TransferReceipt{ID: sweepID, Amount: balance, Currency: currency, CreditedAmount: credited, CreditedCurrency: targetCurrency, Rate: rate}
+	}
+
+	// Nothing scheduled may run against a closed account
+	_, err = tx.Exec("UPDATE standing_orders SET status = 'cancelled' WHERE username = ? AND status = 'active'", account)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+	_, err = tx.Exec("UPDATE savings_goals SET status = 'closed', allocated = 0 WHERE username = ? AND status = 'active'", account)
+	if err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	if err := recordStatusChange(tx, account, "closed", reason, closedBy); err != nil {
+		_ = tx.Rollback()
+		return TransferReceipt{}, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "close", fmt.Sprintf("%s closed %s", closedBy, account))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return TransferReceipt{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return TransferReceipt{}, err
+	}
+
+	return receipt, nil
+}
+
+// Loans
+
+type Loan struct {
+	ID         int64
+	Username   string
+	Principal  float64
+	Currency   string
+	AnnualRate float64 // Percent per year
+	TermMonths int
+	Payment    float64 // Regular monthly installment
+	StartDate  time.Time
+	Status     string // active or paid_off
+}
+
+type Installment struct {
+	Number    int
+	DueDate   time.Time
+	Payment   float64
+	Principal float64
+	Interest  float64
+	Balance   float64 // Principal still owed after this installment
+	LateFee   float64
+	Status    string // scheduled, late, paid or settled
+}
+
+var (
+	loanRepaymentInterval = time.Hour
+	loanGracePeriod       = 5 * 24 * time.Hour
+	loanLateFeeRate       = 0.05 // Share of the installment charged when it is late
+	loanMaxTermMonths     = 360
+)
+
+var errLoanNotFound = errors.New("loan not found")
+
+// loanAccount is the bank-owned account loans are disbursed from and repaid
+// into. Its balance is minus the principal lent out in that currency.
+func loanAccount(currency string) string {
+	return bankAccountPrefix + "loans_" + strings.ToLower(currency)
+}
+
+// amortizationSchedule splits a loan into equal monthly installments. Each
+// installment pays the interest on the remaining principal first, the last
+// one absorbs the rounding so the principal is repaid exactly.
+func amortizationSchedule(principal, annualRate float64, months int, firstDue time.Time, currency string) []Installment {
+	monthlyRate := annualRate / 100 / 12
+	payment := principal / float64(months)
+	if monthlyRate > 0 {
+		payment = principal * monthlyRate / (1 - math.Pow(1+monthlyRate, -float64(months)))
+	}
+	payment = roundToMinorUnits(payment, currency)
+
+	schedule := make([]Installment, 0, months)
+	balance := principal
+	for n := 1; n <= months; n++ {
+		interest := roundToMinorUnits(balance*monthlyRate, currency)
+		part := roundToMinorUnits(payment-interest, currency)
+		if n == months || part > balance {
+			part = balance
+		}
+		balance = roundToMinorUnits(balance-part, currency)
+		schedule = append(schedule, Installment{
+			Number:    n,
+			DueDate:   addMonthsClamped(firstDue, n-1),
+			Payment:   roundToMinorUnits(part+interest, currency),
+			Principal: part,
+			Interest:  interest,
+			Balance:   balance,
+			Status:    "scheduled",
+		})
+	}
+	return schedule
+}
+
+func handleDisburseLoan(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read borrower, principal, annual rate, term in months and first due date from client
+	fields := make([]string, 5)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading loan", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	borrower, principalStr, rateStr, termStr, firstDueStr := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	admin, err := isAdmin(username)
+	if err != nil {
+		log.Error("error checking admin", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !admin {
+		conn.Write([]byte("Permission denied\n"))
+		return
+	}
+
+	// The loan is in the borrower's currency
+	currency, err := getAccountCurrency(borrower)
+	if err == sql.ErrNoRows {
+		conn.Write([]byte("Borrower not found\n"))
+		return
+	}
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	principal, err := parseAmount(principalStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid principal\n"))
+		return
+	}
+	annualRate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || annualRate < 0 || annualRate > 100 {
+		conn.Write([]byte("Invalid interest rate\n"))
+		return
+	}
+	months, err := strconv.Atoi(termStr)
+	if err != nil || months < 1 || months > loanMaxTermMonths {
+		conn.Write([]byte(fmt.Sprintf("Invalid term, use 1 to %d months\n", loanMaxTermMonths)))
+		return
+	}
+
+	// The first installment is due a month from today unless given
+	firstDue := addMonthsClamped(today(), 1)
+	if firstDueStr != "" {
+		firstDue, err = time.Parse(dateLayout, firstDueStr)
+		if err != nil || !firstDue.After(today()) {
+			conn.Write([]byte("Invalid first due date\n"))
+			return
+		}
+	}
+
+	schedule := amortizationSchedule(principal, annualRate, months, firstDue, currency)
+	loan := Loan{Username: borrower, Principal: principal, Currency: currency, AnnualRate: annualRate, TermMonths: months, Payment: schedule[0].Payment, StartDate: today()}
+	id, err := disburseLoan(loan, schedule, username)
+	var statusErr *AccountStatusError
+	if errors.As(err, &statusErr) {
+		conn.Write([]byte(statusErr.Response()))
+		return
+	}
+	if err != nil {
+		log.Error("error disbursing loan", "err", err)
+		conn.Write([]byte("Error disbursing loan\n"))
+		return
+	}
+
+	if err := notifyUser(borrower, fmt.Sprintf("Loan %d of %s has been paid into your account. %d monthly installments of %s from %s",
+		id, formatAmount(principal, currency), months, formatAmount(loan.Payment, currency), firstDue.Format(dateLayout))); err != nil {
+		log.Error("error notifying user", "err", err)
+	}
+	conn.Write([]byte(fmt.Sprintf("Loan %d: %s disbursed to %s at %.2f%%, %d installments of %s from %s\n",
+		id, formatAmount(principal, currency), borrower, annualRate, months, formatAmount(loan.Payment, currency), firstDue.Format(dateLayout))))
+}
+
+// disburseLoan credits the borrower from the bank loan account and stores
+// the loan with its whole schedule in one transaction
+func disburseLoan(loan Loan, schedule []Installment, createdBy string) (int64, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return 0, fmt.Errorf("transaction preparation failed")
+	}
+
+	var status string
+	err = tx.QueryRow("SELECT status FROM account WHERE username = ? FOR UPDATE", loan.Username).Scan(&status)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := checkCanCredit(loan.Username, status); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO loans (username, principal, currency, annual_rate, term_months, payment, start_date, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		loan.Username, loan.Principal, loan.Currency, loan.AnnualRate, loan.TermMonths, loan.Payment, loan.StartDate.Format(dateLayout), createdBy)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	for _, inst := range schedule {
+		_, err = tx.Exec("INSERT INTO loan_installments (loan_id, number, due_date, payment, principal, interest, balance) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			id, inst.Number, inst.DueDate.Format(dateLayout), inst.Payment, inst.Principal, inst.Interest, inst.Balance)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	pool := loanAccount(loan.Currency)
+	if err := creditBankAccount(tx, pool, -loan.Principal); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = adjustBalance(tx, loan.Username, loan.Principal)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	debitID, err := recordTransaction(tx, LedgerEntry{Username: pool, Type: "loan_disbursement", Amount: -loan.Principal, Currency: loan.Currency, Counterparty: loan.Username})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	_, err = recordTransaction(tx, LedgerEntry{Username: loan.Username, Type: "loan_disbursement", Amount: loan.Principal, Currency: loan.Currency, Counterparty: pool, ReferenceID: sql.NullInt64{Int64: debitID, Valid: true}})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "loan_disbursement", fmt.Sprintf("Loan %d of %s to %s", id, formatAmount(loan.Principal, loan.Currency), loan.Username))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return 0, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// loadLoan reads a loan, locking its row when q is a transaction and lock is set
+func loadLoan(q queryRower, id int64, lock bool) (Loan, error) {
+	query := "SELECT id, username, principal, currency, annual_rate, term_months, payment, start_date, status FROM loans WHERE id = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var loan Loan
+	var startDate string
+	err := q.QueryRow(query, id).Scan(&loan.ID, &loan.Username, &loan.Principal, &loan.Currency, &loan.AnnualRate, &loan.TermMonths, &loan.Payment, &startDate, &loan.Status)
+	if err != nil {
+		return loan, err
+	}
+	loan.StartDate, err = time.Parse(dateLayout, startDate)
+	return loan, err
+}
+
+func handleListLoans(conn net.Conn, log *slog.Logger, username string) {
+	rows, err := db.Query("SELECT id, principal, currency, annual_rate, term_months, payment, status FROM loans WHERE username = ? ORDER BY id", username)
+	if err != nil {
+		log.Error("error querying loans", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		if err := rows.Scan(&loan.ID, &loan.Principal, &loan.Currency, &loan.AnnualRate, &loan.TermMonths, &loan.Payment, &loan.Status); err != nil {
+			rows.Close()
+			log.Error("error reading loan", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		loans = append(loans, loan)
+	}
+	rows.Close()
+
+	var message string
+	for _, loan := range loans {
+		message += fmt.Sprintf("Loan %d: %s at %.2f%% over %d months, installment %s, %s",
+			loan.ID, formatAmount(loan.Principal, loan.Currency), loan.AnnualRate, loan.TermMonths, formatAmount(loan.Payment, loan.Currency), loan.Status)
+		if loan.Status == "active" {
+			var nextDue string
+			var outstanding float64
+			err := db.QueryRow("SELECT MIN(due_date), SUM(principal) FROM loan_installments WHERE loan_id = ? AND status IN ('scheduled', 'late')", loan.ID).Scan(&nextDue, &outstanding)
+			if err != nil {
+				log.Error("error reading loan installments", "err", err)
+				conn.Write([]byte("Internal server error\n"))
+				return
+			}
+			message += fmt.Sprintf(", %s outstanding, next due %s", formatAmount(outstanding, loan.Currency), nextDue)
+		}
+		message += "\n"
+	}
+	if message == "" {
+		message = "No loans\n"
+	}
+	conn.Write([]byte(message))
+}
+
+// readLoanID reads a loan ID from the client and loads the loan, which must
+// belong to username unless username is an admin
+func readLoanID(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) (Loan, bool) {
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading loan ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return Loan{}, false
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid loan ID\n"))
+		return Loan{}, false
+	}
+
+	loan, err := loadLoan(db, id, false)
+	if err == sql.ErrNoRows {
+		conn.Write([]byte("Loan not found\n"))
+		return Loan{}, false
+	}
+	if err != nil {
+		log.Error("error reading loan", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return Loan{}, false
+	}
+	if loan.Username != username {
+		admin, err := isAdmin(username)
+		if err != nil {
+			log.Error("error checking admin", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return Loan{}, false
+		}
+		if !admin {
+			conn.Write([]byte("Loan not found\n"))
+			return Loan{}, false
+		}
+	}
+	return loan, true
+}
+
+func handleLoanSchedule(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	loan, ok := readLoanID(conn, log, reader, username)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT number, due_date, payment, principal, interest, balance, late_fee, status FROM loan_installments WHERE loan_id = ? ORDER BY number", loan.ID)
+	if err != nil {
+		log.Error("error querying loan installments", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	message := fmt.Sprintf("Loan %d, %s at %.2f%%:\n", loan.ID, formatAmount(loan.Principal, loan.Currency), loan.AnnualRate)
+	for rows.Next() {
+		var inst Installment
+		var dueDate string
+		if err := rows.Scan(&inst.Number, &dueDate, &inst.Payment, &inst.Principal, &inst.Interest, &inst.Balance, &inst.LateFee, &inst.Status); err != nil {
+			log.Error("error reading loan installment", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("#%d %s: %s (principal %s, interest %s), remaining %s, %s",
+			inst.Number, dueDate, formatAmount(inst.Payment, loan.Currency), formatAmount(inst.Principal, loan.Currency),
+			formatAmount(inst.Interest, loan.Currency), formatAmount(inst.Balance, loan.Currency), inst.Status)
+		if inst.LateFee > 0 {
+			message += ", late fee " + formatAmount(inst.LateFee, loan.Currency)
+		}
+		message += "\n"
+	}
+	conn.Write([]byte(message))
+}
+
+// PayoffQuote is what it costs to repay a loan in full on a given day
+type PayoffQuote struct {
+	Principal float64 // All principal not yet repaid
+	Interest  float64 // Interest of overdue installments plus interest accrued since the last due date
+	LateFees  float64
+	Currency  string
+	AsOf      time.Time
+}
+
+func (q PayoffQuote) Total() float64 {
+	return roundToMinorUnits(q.Principal+q.Interest+q.LateFees, q.Currency)
+}
+
+// payoffQuote prices the early repayment of loan on day asOf. Interest on the
+// principal not yet due accrues daily since the last due date.
+func payoffQuote(q queryRower, loan Loan, asOf time.Time) (PayoffQuote, error) {
+	quote := PayoffQuote{Currency: loan.Currency, AsOf: asOf}
+	day := asOf.Format(dateLayout)
+
+	var overdueInterest, futurePrincipal float64
+	err := q.QueryRow("SELECT COALESCE(SUM(principal), 0), COALESCE(SUM(CASE WHEN due_date <= ? THEN interest ELSE 0 END), 0), COALESCE(SUM(late_fee), 0), COALESCE(SUM(CASE WHEN due_date > ? THEN principal ELSE 0 END), 0) FROM loan_installments WHERE loan_id = ? AND status IN ('scheduled', 'late')",
+		day, day, loan.ID).Scan(&quote.Principal, &overdueInterest, &quote.LateFees, &futurePrincipal)
+	if err != nil {
+		return quote, err
+	}
+
+	// Accrue from the last due date, or from disbursement before the first one
+	since := loan.StartDate
+	var lastDue sql.NullString
+	err = q.QueryRow("SELECT MAX(due_date) FROM loan_installments WHERE loan_id = ? AND due_date <= ?", loan.ID, day).Scan(&lastDue)
+	if err != nil {
+		return quote, err
+	}
+	if lastDue.Valid {
+		if since, err = time.Parse(dateLayout, lastDue.String); err != nil {
+			return quote, err
+		}
+	}
+	accrued := accruedInterest(futurePrincipal, loan.AnnualRate, since, asOf)
+
+	quote.Interest = roundToMinorUnits(overdueInterest+accrued, loan.Currency)
+	return quote, nil
+}
+
+// accruedInterest is the simple interest on principal at annualRate percent,
+// accrued daily on a 365-day year from since to asOf
+func accruedInterest(principal, annualRate float64, since, asOf time.Time) float64 {
+	days := asOf.Sub(since).Hours() / 24
+	return principal * annualRate / 100 / 365 * days
+}
+
+func handlePayoffQuote(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	loan, ok := readLoanID(conn, log, reader, username)
+	if !ok {
+		return
+	}
+	if loan.Status != "active" {
+		conn.Write([]byte(fmt.Sprintf("Loan %d is %s\n", loan.ID, loan.Status)))
+		return
+	}
+
+	quote, err := payoffQuote(db, loan, today())
+	if err != nil {
+		log.Error("error computing payoff quote", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Payoff of loan %d on %s: %s (principal %s, interest %s, late fees %s)\n",
+		loan.ID, quote.AsOf.Format(dateLayout), formatAmount(quote.Total(), loan.Currency), formatAmount(quote.Principal, loan.Currency),
+		formatAmount(quote.Interest, loan.Currency), formatAmount(quote.LateFees, loan.Currency))))
+}
+
+func handlePayOffLoan(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	loan, ok := readLoanID(conn, log, reader, username)
+	if !ok {
+		return
+	}
+	if loan.Username != username {
+		conn.Write([]byte("Only the borrower can pay off a loan\n"))
+		return
+	}
+
+	quote, err := payOffLoan(loan.ID, username)
+	var statusErr *AccountStatusError
+	switch {
+	case errors.Is(err, errLoanNotFound):
+		conn.Write([]byte("Loan is not active\n"))
+		return
+	case errors.Is(err, errInsufficientFunds):
+		conn.Write([]byte("Insufficient balance to pay off the loan\n"))
+		return
+	case errors.As(err, &statusErr):
+		conn.Write([]byte(statusErr.Response()))
+		return
+	case err != nil:
+		log.Error("error paying off loan", "err", err)
+		conn.Write([]byte("Error paying off loan\n"))
+		return
+	}
+
+	balance, err := getBalance(username)
+	if err != nil {
+		log.Error("error getting current balance", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Loan %d paid off with %s. Updated balance: %s\n", loan.ID, formatAmount(quote.Total(), loan.Currency), balance)))
+}
+
+// payOffLoan repays everything the borrower owes at today's quote and closes
+// the remaining installments
+func payOffLoan(id int64, username string) (PayoffQuote, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return PayoffQuote{}, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return PayoffQuote{}, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Lock the loan first so the scheduler cannot collect an installment meanwhile
+	loan, err := loadLoan(tx, id, true)
+	if err == sql.ErrNoRows || (err == nil && (loan.Username != username || loan.Status != "active")) {
+		_ = tx.Rollback()
+		return PayoffQuote{}, errLoanNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+
+	var balance float64
+	var status string
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, username); err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	err = tx.QueryRow("SELECT balance, status FROM account WHERE username = ? FOR UPDATE", username).Scan(&balance, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	if err := checkCanDebit(username, status); err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+
+	quote, err := payoffQuote(tx, loan, today())
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	available, err := availableBalance(tx, username, balance)
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	if available < quote.Total() {
+		_ = tx.Rollback()
+		return PayoffQuote{}, errInsufficientFunds
+	}
+
+	if err := postLoanRepayment(tx, loan, quote.Principal, quote.Interest, quote.LateFees); err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	_, err = tx.Exec("UPDATE loan_installments SET status = 'settled', paid_at = ? WHERE loan_id = ? AND status IN ('scheduled', 'late')", time.Now().UTC(), loan.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+	_, err = tx.Exec("UPDATE loans SET status = 'paid_off' WHERE id = ?", loan.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return PayoffQuote{}, err
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "loan_payoff", fmt.Sprintf("%s paid off loan %d with %s", username, loan.ID, formatAmount(quote.Total(), loan.Currency)))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return PayoffQuote{}, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return PayoffQuote{}, err
+	}
+
+	return quote, nil
+}
+
+// postLoanRepayment debits the borrower inside tx. The principal goes back to
+// the bank loan account, interest and late fees to the bank revenue account.
+func postLoanRepayment(tx *sql.Tx, loan Loan, principal, interest, lateFees float64) error {
+	pool := loanAccount(loan.Currency)
+	revenue := revenueAccount(loan.Currency)
+	amount := roundToMinorUnits(principal+interest, loan.Currency)
+
+	err := adjustBalance(tx, loan.Username, -amount)
+	if err != nil {
+		return err
+	}
+	repaymentID, err := recordTransaction(tx, LedgerEntry{Username: loan.Username, Type: "loan_repayment", Amount: -amount, Currency: loan.Currency, Counterparty: pool})
+	if err != nil {
+		return err
+	}
+	reference := sql.NullInt64{Int64: repaymentID, Valid: true}
+
+	if err := creditBankAccount(tx, pool, principal); err != nil {
+		return err
+	}
+	_, err = recordTransaction(tx, LedgerEntry{Username: pool, Type: "loan_repayment", Amount: principal, Currency: loan.Currency, Counterparty: loan.Username, ReferenceID: reference})
+	if err != nil {
+		return err
+	}
+
+	if interest > 0 {
+		if err := creditBankAccount(tx, revenue, interest); err != nil {
+			return err
+		}
+		_, err = recordTransaction(tx, LedgerEntry{Username: revenue, Type: "loan_interest", Amount: interest, Currency: loan.Currency, Counterparty: loan.Username, ReferenceID: reference})
+		if err != nil {
+			return err
+		}
+	}
+
+	return postFee(tx, loan.Username, loan.Username, loan.Currency, lateFees, repaymentID)
+}
+
+func startLoanScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := runLoanRepayments(time.Now().UTC()); err != nil {
+			logger.Error("error running loan repayments", "err", err)
+		}
+		finishOperation()
+		time.Sleep(loanRepaymentInterval)
+	}
+}
+
+// runLoanRepayments collects every installment that is due, oldest first.
+// Unpaid installments are retried on every run until they are collected.
+func runLoanRepayments(now time.Time) error {
+	rows, err := db.Query("SELECT i.loan_id, i.number FROM loan_installments i JOIN loans l ON l.id = i.loan_id WHERE l.status = 'active' AND i.status IN ('scheduled', 'late') AND i.due_date <= ? ORDER BY i.due_date, i.loan_id",
+		now.Format(dateLayout))
+	if err != nil {
+		return err
+	}
+	type due struct {
+		loanID int64
+		number int
+	}
+	var installments []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.loanID, &d.number); err != nil {
+			rows.Close()
+			return err
+		}
+		installments = append(installments, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Once an installment of a loan fails, later ones wait for the next run
+	failed := make(map[int64]bool)
+	for _, d := range installments {
+		if failed[d.loanID] {
+			continue
+		}
+		paid, err := collectInstallment(d.loanID, d.number, now)
+		if err != nil {
+			logger.Error("error collecting loan installment", "loan", d.loanID, "installment", d.number, "err", err)
+		}
+		if !paid {
+			failed[d.loanID] = true
+		}
+	}
+	return nil
+}
+
+// collectInstallment debits one installment and any late fee on it. When the
+// borrower cannot pay, the installment is marked late after the grace period.
+func collectInstallment(loanID int64, number int, now time.Time) (bool, error) {
+	// Start a new transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// Prepare the transaction
+	if !coordinator.Prepare() {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("transaction preparation failed")
+	}
+
+	// Re-read the loan and installment under lock, they may have been paid by now
+	loan, err := loadLoan(tx, loanID, true)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	var inst Installment
+	var dueDate string
+	err = tx.QueryRow("SELECT number, due_date, payment, principal, interest, late_fee, status FROM loan_installments WHERE loan_id = ? AND number = ? FOR UPDATE", loanID, number).
+		Scan(&inst.Number, &dueDate, &inst.Payment, &inst.Principal, &inst.Interest, &inst.LateFee, &inst.Status)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if loan.Status != "active" || (inst.Status != "scheduled" && inst.Status != "late") {
+		_ = tx.Rollback()
+		return true, nil
+	}
+	if inst.DueDate, err = time.Parse(dateLayout, dueDate); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	var balance float64
+	var status string
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, loan.Username); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	err = tx.QueryRow("SELECT balance, status FROM account WHERE username = ? FOR UPDATE", loan.Username).Scan(&balance, &status)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	cause := checkCanDebit(loan.Username, status)
+	if cause == nil {
+		available, err := availableBalance(tx, loan.Username, balance)
+		if err != nil {
+			_ = tx.Rollback()
+			return false, err
+		}
+		if available < inst.Payment+inst.LateFee {
+			cause = errInsufficientFunds
+		}
+	}
+	if cause != nil {
+		_ = tx.Rollback()
+		return false, recordMissedInstallment(loan, inst, cause, now)
+	}
+
+	if err := postLoanRepayment(tx, loan, inst.Principal, inst.Interest, inst.LateFee); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE loan_installments SET status = 'paid', paid_at = ? WHERE loan_id = ? AND number = ?", now, loanID, number)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	// The loan is paid off with its last installment
+	var remaining int
+	err = tx.QueryRow("SELECT COUNT(*) FROM loan_installments WHERE loan_id = ? AND status IN ('scheduled', 'late')", loanID).Scan(&remaining)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if remaining == 0 {
+		if _, err := tx.Exec("UPDATE loans SET status = 'paid_off' WHERE id = ?", loanID); err != nil {
+			_ = tx.Rollback()
+			return false, err
+		}
+	}
+
+	// Add the transaction to the coordinator
+	txID := coordinator.NextID()
+	coordinator.AddTransaction(txID, "loan_repayment", fmt.Sprintf("%s repaid installment %d of loan %d", loan.Username, number, loanID))
+	defer coordinator.RemoveTransaction(txID)
+
+	// Commit the transaction
+	if !coordinator.Commit() {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("transaction commit failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if remaining == 0 {
+		if err := notifyUser(loan.Username, fmt.Sprintf("Loan %d is paid off", loanID)); err != nil {
+			logger.Error("error notifying user", "err", err)
+		}
+	}
+	return true, nil
+}
+
+// recordMissedInstallment charges the late fee once the grace period is over.
+// The fee is only added to the installment, it is collected with it.
+func recordMissedInstallment(loan Loan, inst Installment, cause error, now time.Time) error {
+	if inst.Status != "scheduled" || now.Before(inst.DueDate.Add(loanGracePeriod)) {
+		return nil
+	}
+
+	lateFee := roundToMinorUnits(inst.Payment*loanLateFeeRate, loan.Currency)
+	result, err := db.Exec("UPDATE loan_installments SET status = 'late', late_fee = ? WHERE loan_id = ? AND number = ? AND status = 'scheduled'", lateFee, loan.ID, inst.Number)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+
+	reason := "insufficient balance"
+	var statusErr *AccountStatusError
+	if errors.As(cause, &statusErr) {
+		reason = statusErr.Error()
+	}
+	return notifyUser(loan.Username, fmt.Sprintf("Installment %d of loan %d (%s) due %s is late: %s. A late fee of %s has been added",
+		inst.Number, loan.ID, formatAmount(inst.Payment, loan.Currency), inst.DueDate.Format(dateLayout), reason, formatAmount(lateFee, loan.Currency)))
+}
+
+// Savings Goals
+
+// SavingsGoal is money set aside inside an account. The allocated amount
+// stays in the ledger balance but is no longer available.
+type SavingsGoal struct {
+	ID         int64
+	Name       string
+	Target     float64
+	TargetDate sql.NullString
+	Allocated  float64
+	Reached    bool
+}
+
+var goalSweepInterval = time.Hour
+
+var (
+	errGoalNotFound     = errors.New("savings goal not found")
+	errInsufficientGoal = errors.New("not enough money in savings goal")
+)
+
+// goalsAmount returns the total set aside in the active goals of an account
+func goalsAmount(q queryRower, username string) (float64, error) {
+	var saved float64
+	err := q.QueryRow("SELECT COALESCE(SUM(allocated), 0) FROM savings_goals WHERE username = ? AND status = 'active'", username).Scan(&saved)
+	return saved, err
+}
+
+// lockGoal loads an active goal of username by name inside tx, locking its row
+func lockGoal(tx *sql.Tx, username, name string) (SavingsGoal, error) {
+	var goal SavingsGoal
+	err := tx.QueryRow("SELECT id, name, target, target_date, allocated, reached FROM savings_goals WHERE username = ? AND name = ? AND status = 'active' FOR UPDATE", username, name).
+		Scan(&goal.ID, &goal.Name, &goal.Target, &goal.TargetDate, &goal.Allocated, &goal.Reached)
+	if err == sql.ErrNoRows {
+		return goal, errGoalNotFound
+	}
+	return goal, err
+}
+
+// allocateToGoal changes the amount set aside in a goal inside tx and records
+// the movement. It reports whether this movement made the goal reach its target.
+func allocateToGoal(tx *sql.Tx, goal SavingsGoal, amount float64, kind string) (bool, error) {
+	allocated := goal.Allocated + amount
+	reached := !goal.Reached && allocated >= goal.Target
+	_, err := tx.Exec("UPDATE savings_goals SET allocated = ?, reached = reached OR ? WHERE id = ?", allocated, reached, goal.ID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("INSERT INTO goal_movements (goal_id, amount, kind) VALUES (?, ?, ?)", goal.ID, amount, kind)
+	return reached, err
+}
+
+func notifyGoalReached(username string, goal SavingsGoal, currency string) {
+	message := fmt.Sprintf("Savings goal %s reached its target of %s", goal.Name, formatAmount(goal.Target, currency))
+	if err := notifyUser(username, message); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+}
+
+func handleCreateGoal(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read name, target amount and target date from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading savings goal", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	name, targetStr, dateStr := fields[0], fields[1], fields[2]
+
+	if name == "" {
+		conn.Write([]byte("Invalid goal name\n"))
+		return
+	}
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	target, err := parseAmount(targetStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid target amount\n"))
+		return
+	}
+	targetDate := sql.NullString{String: dateStr, Valid: dateStr != ""}
+	if targetDate.Valid {
+		date, err := time.Parse(dateLayout, dateStr)
+		if err != nil || !date.After(today()) {
+			conn.Write([]byte("Invalid target date\n"))
+			return
+		}
+	}
+
+	// Goal names are unique among the active goals of an account
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM savings_goals WHERE username = ? AND name = ? AND status = 'active'", username, name).Scan(&count)
+	if err != nil {
+		log.Error("error checking savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if count > 0 {
+		conn.Write([]byte("A goal with this name already exists\n"))
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO savings_goals (username, name, target, target_date) VALUES (?, ?, ?, ?)", username, name, target, targetDate)
+	if err != nil {
+		log.Error("error inserting savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	message := fmt.Sprintf("Savings goal %s created with a target of %s", name, formatAmount(target, currency))
+	if targetDate.Valid {
+		message += " by " + dateStr
+	}
+	conn.Write([]byte(message + "\n"))
+}
+
+// goalProgress describes how far a goal is and, when it has a target date,
+// how much is still needed each month to get there
+func goalProgress(goal SavingsGoal, currency string, now time.Time) string {
+	percent := 100.0
+	if goal.Target > 0 && goal.Allocated < goal.Target {
+		percent = goal.Allocated / goal.Target * 100
+	}
+	progress := fmt.Sprintf("%s of %s (%.0f%%)", formatAmount(goal.Allocated, currency), formatAmount(goal.Target, currency), percent)
+	if !goal.TargetDate.Valid {
+		return progress
+	}
+
+	progress += ", target date " + goal.TargetDate.String
+	remaining := goal.Target - goal.Allocated
+	date, err := time.Parse(dateLayout, goal.TargetDate.String)
+	if err != nil || remaining <= 0 {
+		return progress
+	}
+	months := 0
+	for addMonthsClamped(now, months+1).Before(date) || addMonthsClamped(now, months+1).Equal(date) {
+		months++
+	}
+	if months == 0 {
+		return progress + fmt.Sprintf(", %s still needed", formatAmount(remaining, currency))
+	}
+	return progress + fmt.Sprintf(", %s a month needed", formatAmount(roundToMinorUnits(remaining/float64(months), currency), currency))
+}
+
+func handleListGoals(conn net.Conn, log *slog.Logger, username string) {
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	rows, err := db.Query("SELECT id, name, target, target_date, allocated, reached FROM savings_goals WHERE username = ? AND status = 'active' ORDER BY id", username)
+	if err != nil {
+		log.Error("error querying savings goals", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	var goals []SavingsGoal
+	for rows.Next() {
+		var goal SavingsGoal
+		if err := rows.Scan(&goal.ID, &goal.Name, &goal.Target, &goal.TargetDate, &goal.Allocated, &goal.Reached); err != nil {
+			rows.Close()
+			log.Error("error reading savings goal", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		goals = append(goals, goal)
+	}
+	rows.Close()
+
+	var message string
+	for _, goal := range goals {
+		message += fmt.Sprintf("%s: %s\n", goal.Name, goalProgress(goal, currency, today()))
+
+		rules, err := db.Query("SELECT kind, amount, frequency, next_run FROM goal_rules WHERE goal_id = ? ORDER BY id", goal.ID)
+		if err != nil {
+			log.Error("error querying goal rules", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		for rules.Next() {
+			var kind string
+			var amount float64
+			var frequency, nextRun sql.NullString
+			if err := rules.Scan(&kind, &amount, &frequency, &nextRun); err != nil {
+				rules.Close()
+				log.Error("error reading goal rule", "err", err)
+				conn.Write([]byte("Internal server error\n"))
+				return
+			}
+			if kind == "roundup" {
+				message += fmt.Sprintf("  round-up of withdrawals to %s\n", formatAmount(amount, currency))
+			} else {
+				message += fmt.Sprintf("  %s %s, next on %s\n", formatAmount(amount, currency), frequency.String, nextRun.String)
+			}
+		}
+		rules.Close()
+	}
+	if message == "" {
+		message = "No savings goals\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleAddGoalRule(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read goal name, kind, amount and frequency from client
+	fields := make([]string, 4)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading goal rule", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	name, kind, amountStr, frequency := fields[0], strings.ToLower(fields[1]), fields[2], strings.ToLower(fields[3])
+
+	if kind != "fixed" && kind != "roundup" {
+		conn.Write([]byte("Invalid rule kind, use fixed or roundup\n"))
+		return
+	}
+	if kind == "fixed" && frequency != "weekly" && frequency != "monthly" {
+		conn.Write([]byte("Invalid frequency, use weekly or monthly\n"))
+		return
+	}
+
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	// For round-ups the amount is the unit withdrawals are rounded up to
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid amount\n"))
+		return
+	}
+
+	var goalID int64
+	err = db.QueryRow("SELECT id FROM savings_goals WHERE username = ? AND name = ? AND status = 'active'", username, name).Scan(&goalID)
+	if err == sql.ErrNoRows {
+		conn.Write([]byte("Savings goal not found\n"))
+		return
+	}
+	if err != nil {
+		log.Error("error reading savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	// Fixed sweeps start today and repeat from there
+	var message string
+	if kind == "roundup" {
+		_, err = db.Exec("INSERT INTO goal_rules (goal_id, kind, amount) VALUES (?, 'roundup', ?)", goalID, amount)
+		message = fmt.Sprintf("Withdrawals will be rounded up to %s into %s\n", formatAmount(amount, currency), name)
+	} else {
+		start := today().Format(dateLayout)
+		_, err = db.Exec("INSERT INTO goal_rules (goal_id, kind, amount, frequency, start_date, next_run) VALUES (?, 'fixed', ?, ?, ?, ?)", goalID, amount, frequency, start, start)
+		message = fmt.Sprintf("%s will be set aside %s into %s, starting today\n", formatAmount(amount, currency), frequency, name)
+	}
+	if err != nil {
+		log.Error("error inserting goal rule", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	conn.Write([]byte(message))
+}
+
+func handleMoveGoalFunds(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read goal name, direction and amount from client
+	fields := make([]string, 3)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading goal movement", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	name, direction, amountStr := fields[0], strings.ToLower(fields[1]), fields[2]
+
+	if direction != "in" && direction != "out" {
+		conn.Write([]byte("Invalid direction, use in or out\n"))
+		return
+	}
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	amount, err := parseAmount(amountStr, currency)
+	if err != nil {
+		conn.Write([]byte("Invalid amount\n"))
+		return
+	}
+	if direction == "out" {
+		amount = -amount
+	}
+
+	goal, reached, err := moveGoalFunds(username, name, amount)
+	switch {
+	case errors.Is(err, errGoalNotFound):
+		conn.Write([]byte("Savings goal not found\n"))
+		return
+	case errors.Is(err, errInsufficientFunds):
+		conn.Write([]byte("Insufficient available balance\n"))
+		return
+	case errors.Is(err, errInsufficientGoal):
+		conn.Write([]byte("Not enough money in the savings goal\n"))
+		return
+	case err != nil:
+		log.Error("error moving goal funds", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	if reached {
+		notifyGoalReached(username, goal, currency)
+	}
+	conn.Write([]byte(fmt.Sprintf("%s: %s\n", goal.Name, goalProgress(goal, currency, today()))))
+}
+
+// moveGoalFunds sets money aside in a goal, or gives it back to the available
+// balance when amount is negative. It returns the goal after the movement.
+func moveGoalFunds(username, name string, amount float64) (SavingsGoal, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return SavingsGoal{}, false, err
+	}
+
+	// Lock the account first, as every debit does, then the goal
+	var balance float64
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, username); err != nil {
+		_ = tx.Rollback()
+		return SavingsGoal{}, false, err
+	}
+	err = tx.QueryRow("SELECT balance FROM account WHERE username = ? FOR UPDATE", username).Scan(&balance)
+	if err != nil {
+		_ = tx.Rollback()
+		return SavingsGoal{}, false, err
+	}
+	goal, err := lockGoal(tx, username, name)
+	if err != nil {
+		_ = tx.Rollback()
+		return SavingsGoal{}, false, err
+	}
+
+	if amount > 0 {
+		available, err := availableBalance(tx, username, balance)
+		if err != nil {
+			_ = tx.Rollback()
+			return SavingsGoal{}, false, err
+		}
+		if available < amount {
+			_ = tx.Rollback()
+			return SavingsGoal{}, false, errInsufficientFunds
+		}
+	} else if goal.Allocated < -amount {
+		_ = tx.Rollback()
+		return SavingsGoal{}, false, errInsufficientGoal
+	}
+
+	reached, err := allocateToGoal(tx, goal, amount, "manual")
+	if err != nil {
+		_ = tx.Rollback()
+		return SavingsGoal{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return SavingsGoal{}, false, err
+	}
+
+	goal.Allocated += amount
+	return goal, reached, nil
+}
+
+func handleCloseGoal(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read goal name from client
+	name, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading goal name", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	name = strings.TrimSpace(name)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("error starting transaction", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	goal, err := lockGoal(tx, username, name)
+	if err == errGoalNotFound {
+		_ = tx.Rollback()
+		conn.Write([]byte("Savings goal not found\n"))
+		return
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.Error("error reading savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	// The money set aside becomes available again
+	if _, err := tx.Exec("UPDATE savings_goals SET status = 'closed', allocated = 0 WHERE id = ?", goal.ID); err != nil {
+		_ = tx.Rollback()
+		log.Error("error closing savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM goal_rules WHERE goal_id = ?", goal.ID); err != nil {
+		_ = tx.Rollback()
+		log.Error("error closing savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("error closing savings goal", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Savings goal %s closed, %s is available again\n", name, formatAmount(goal.Allocated, currency))))
+}
+
+// applyRoundUps sets aside the difference between a withdrawal and the next
+// multiple of each round-up rule's unit. It runs inside the withdrawal's
+// transaction with the account row locked. Round-ups the available balance
+// cannot cover, or that would overshoot a goal's target, are skipped. It
+// returns the goals that reached their target, to notify after the commit.
+func applyRoundUps(tx *sql.Tx, username, currency string, amount float64) ([]SavingsGoal, error) {
+	rows, err := tx.Query("SELECT g.name, r.amount FROM goal_rules r JOIN savings_goals g ON g.id = r.goal_id WHERE g.username = ? AND g.status = 'active' AND r.kind = 'roundup' ORDER BY r.id", username)
+	if err != nil {
+		return nil, err
+	}
+	type roundUp struct {
+		goal string
+		unit float64
+	}
+	var rules []roundUp
+	for rows.Next() {
+		var r roundUp
+		if err := rows.Scan(&r.goal, &r.unit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var completed []SavingsGoal
+	for _, r := range rules {
+		extra := roundToMinorUnits(math.Ceil(amount/r.unit)*r.unit-amount, currency)
+		if extra <= 0 {
+			continue
+		}
+		goal, err := lockGoal(tx, username, r.goal)
+		if err != nil {
+			return nil, err
+		}
+		if goal.Allocated+extra > goal.Target {
+			continue
+		}
+		var balance float64
+		if err := tx.QueryRow("SELECT balance FROM account WHERE username = ?", username).Scan(&balance); err != nil {
+			return nil, err
+		}
+		available, err := availableBalance(tx, username, balance)
+		if err != nil {
+			return nil, err
+		}
+		if available < extra {
+			continue
+		}
+		reached, err := allocateToGoal(tx, goal, extra, "roundup")
+		if err != nil {
+			return nil, err
+		}
+		if reached {
+			completed = append(completed, goal)
+		}
+	}
+	return completed, nil
+}
+
+func startGoalSweepScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := runGoalSweeps(today()); err != nil {
+			logger.Error("error running savings goal sweeps", "err", err)
+		}
+		finishOperation()
+		time.Sleep(goalSweepInterval)
+	}
+}
+
+func runGoalSweeps(day time.Time) error {
+	rows, err := db.Query("SELECT r.id FROM goal_rules r JOIN savings_goals g ON g.id = r.goal_id WHERE g.status = 'active' AND r.kind = 'fixed' AND r.next_run <= ? ORDER BY r.next_run, r.id", day.Format(dateLayout))
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := sweepIntoGoal(id, day); err != nil {
+			logger.Error("error sweeping into savings goal", "rule", id, "err", err)
+		}
+	}
+	return nil
+}
+
+// sweepIntoGoal runs one occurrence of a fixed sweep. A sweep the available
+// balance cannot cover is skipped and the owner told; sweeps stop at the target.
+func sweepIntoGoal(ruleID int64, day time.Time) error {
+	var username, name string
+	err := db.QueryRow("SELECT g.username, g.name FROM goal_rules r JOIN savings_goals g ON g.id = r.goal_id WHERE r.id = ?", ruleID).Scan(&username, &name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Lock the account, then the goal and the rule, which may have run or been removed by now
+	var balance float64
+	var currency string
+	// In event-sourced mode the balance is checked against the stream
+	if err := lockAccountStream(tx, username); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow("SELECT balance, currency FROM account WHERE username = ? FOR UPDATE", username).Scan(&balance, &currency)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	goal, err := lockGoal(tx, username, name)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == errGoalNotFound {
+			return nil
+		}
+		return err
+	}
+	var amount float64
+	var frequency, startStr, nextRun string
+	var occurrence int
+	err = tx.QueryRow("SELECT amount, frequency, start_date, next_run, occurrence FROM goal_rules WHERE id = ? FOR UPDATE", ruleID).Scan(&amount, &frequency, &startStr, &nextRun, &occurrence)
+	if err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if nextRun > day.Format(dateLayout) {
+		_ = tx.Rollback()
+		return nil
+	}
+	start, err := time.Parse(dateLayout, startStr)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Move the rule to its next occurrence whatever happens to this one
+	occurrence++
+	next := start.AddDate(0, 0, 7*occurrence)
+	if frequency == "monthly" {
+		next = addMonthsClamped(start, occurrence)
+	}
+	_, err = tx.Exec("UPDATE goal_rules SET occurrence = ?, next_run = ? WHERE id = ?", occurrence, next.Format(dateLayout), ruleID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if remaining := goal.Target - goal.Allocated; amount > remaining {
+		amount = roundToMinorUnits(math.Max(remaining, 0), currency)
+	}
+	available, err := availableBalance(tx, username, balance)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	skipped := amount > 0 && available < amount
+	reached := false
+	if amount > 0 && !skipped {
+		if reached, err = allocateToGoal(tx, goal, amount, "sweep"); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if skipped {
+		return notifyUser(username, fmt.Sprintf("Savings sweep of %s into %s on %s skipped: insufficient available balance", formatAmount(amount, currency), name, nextRun))
+	}
+	if reached {
+		notifyGoalReached(username, goal, currency)
+	}
+	return nil
+}
+
+// Monthly Statements
+
+type StatementEntry struct {
+	ID           int64
+	Date         string
+	Type         string
+	Counterparty string
+	Amount       float64
+	Balance      float64 // Running balance after the entry
+}
+
+type Statement struct {
+	Account  string
+	Currency string
+	Month    time.Time // First day of the month
+	Opening  float64
+	Closing  float64
+	Fees     float64 // Total fees charged, as a positive amount
+	Interest float64 // Total interest credited
+	Entries  []StatementEntry
+}
+
+var (
+	statementsDir     = "statements"
+	statementInterval = time.Hour
+)
+
+const monthLayout = "2006-01"
+
+// buildStatement collects the ledger entries of an account for one month.
+// The opening balance is derived from the current balance like closingBalance.
+func buildStatement(account string, month time.Time) (Statement, error) {
+	statement := Statement{Account: account, Month: month}
+	currency, err := getAccountCurrency(account)
+	if err != nil {
+		return statement, err
+	}
+	statement.Currency = currency
+	statement.Opening, err = closingBalance(account, month.AddDate(0, 0, -1))
+	if err != nil {
+		return statement, err
+	}
+
+	rows, err := db.Query("SELECT id, created_at, type, counterparty, amount FROM transactions WHERE username = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, id",
+		account, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return statement, err
+	}
+	defer rows.Close()
+
+	balance := statement.Opening
+	for rows.Next() {
+		var entry StatementEntry
+		if err := rows.Scan(&entry.ID, &entry.Date, &entry.Type, &entry.Counterparty, &entry.Amount); err != nil {
+			return statement, err
+		}
+		balance += entry.Amount
+		entry.Balance = balance
+		switch entry.Type {
+		case "fee":
+			statement.Fees -= entry.Amount
+		case "interest":
+			statement.Interest += entry.Amount
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+	statement.Closing = balance
+	return statement, rows.Err()
+}
+
+// plainAmount formats an amount with the currency's minor units and no symbol
+func plainAmount(amount float64, currency string) string {
+	minorUnits := 2
+	if c, ok := currencies[currency]; ok {
+		minorUnits = c.MinorUnits
+	}
+	return strconv.FormatFloat(roundToMinorUnits(amount, currency), 'f', minorUnits, 64)
+}
+
+// writeStatementCSV writes one row per ledger entry between an opening and a
+// closing balance row, followed by the fee and interest totals
+func writeStatementCSV(w io.Writer, s Statement) error {
+	last := s.Month.AddDate(0, 1, -1).Format(dateLayout)
+	out := csv.NewWriter(w)
+	records := [][]string{
+		{"date", "reference", "type", "counterparty", "amount", "balance"},
+		{s.Month.Format(dateLayout), "", "opening_balance", "", "", plainAmount(s.Opening, s.Currency)},
+	}
+	for _, e := range s.Entries {
+		records = append(records, []string{e.Date, strconv.FormatInt(e.ID, 10), e.Type, e.Counterparty, plainAmount(e.Amount, s.Currency), plainAmount(e.Balance, s.Currency)})
+	}
+	records = append(records,
+		[]string{last, "", "closing_balance", "", "", plainAmount(s.Closing, s.Currency)},
+		[]string{last, "", "total_fees", "", plainAmount(s.Fees, s.Currency), ""},
+		[]string{last, "", "total_interest", "", plainAmount(s.Interest, s.Currency), ""},
+	)
+	if err := out.WriteAll(records); err != nil {
+		return err
+	}
+	return out.Error()
+}
+
+// statementLines lays the statement out as fixed-width text for the PDF
+func statementLines(s Statement) []string {
+	lines := []string{
+		fmt.Sprintf("Statement for %s - %s", s.Account, s.Month.Format("January 2006")),
+		fmt.Sprintf("Currency: %s", s.Currency),
+		"",
+		fmt.Sprintf("Opening balance: %s", formatAmount(s.Opening, s.Currency)),
+		fmt.Sprintf("Closing balance: %s", formatAmount(s.Closing, s.Currency)),
+		fmt.Sprintf("Fees charged:    %s", formatAmount(s.Fees, s.Currency)),
+		fmt.Sprintf("Interest earned: %s", formatAmount(s.Interest, s.Currency)),
+		"",
+		fmt.Sprintf("%-19s %-8s %-18s %-16s %14s %14s", "Date", "Ref", "Type", "Counterparty", "Amount", "Balance"),
+	}
+	for _, e := range s.Entries {
+		counterparty := e.Counterparty
+		if len(counterparty) > 16 {
+			counterparty = counterparty[:15] + "~"
+		}
+		lines = append(lines, fmt.Sprintf("%-19s %-8d %-18s %-16s %14s %14s",
+			e.Date, e.ID, e.Type, counterparty, plainAmount(e.Amount, s.Currency), plainAmount(e.Balance, s.Currency)))
+	}
+	if len(s.Entries) == 0 {
+		lines = append(lines, "No transactions this month")
+	}
+	return lines
+}
+
+// writePDF renders lines of text as a plain PDF in a monospaced font, paging
+// every linesPerPage lines. It needs no external library.
+func writePDF(w io.Writer, lines []string) error {
+	const linesPerPage = 60
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1 to 3 are the catalog, the page tree and the font, then a page
+	// and its content stream for every page
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	)
+	escaper := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	for i, page := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT /F1 8 Tf 40 800 Td 12 TL\n")
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", escaper.Replace(line))
+		}
+		content.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// statementPath returns where a statement file is stored, keeping only
+// characters that are safe in a file name
+func statementPath(account string, month time.Time, ext string) string {
+	return filepath.Join(statementsDir, safeFileName(account), month.Format(monthLayout)+"."+ext)
+}
+
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// generateStatement builds the statement of an account for a month and
+// writes it as CSV and PDF. It returns the statement and the file paths.
+func generateStatement(account string, month time.Time) (Statement, []string, error) {
+	statement, err := buildStatement(account, month)
+	if err != nil {
+		return statement, nil, err
+	}
+
+	paths := []string{statementPath(account, month, "csv"), statementPath(account, month, "pdf")}
+	if err := os.MkdirAll(filepath.Dir(paths[0]), 0o755); err != nil {
+		return statement, nil, err
+	}
+	writers := []func(io.Writer) error{
+		func(w io.Writer) error { return writeStatementCSV(w, statement) },
+		func(w io.Writer) error { return writePDF(w, statementLines(statement)) },
+	}
+	for i, path := range paths {
+		file, err := os.Create(path)
+		if err != nil {
+			return statement, nil, err
+		}
+		if err := writers[i](file); err != nil {
+			file.Close()
+			return statement, nil, err
+		}
+		if err := file.Close(); err != nil {
+			return statement, nil, err
+		}
+	}
+	return statement, paths, nil
+}
+
+func handleStatement(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read month (YYYY-MM) from client
+	monthStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading statement month", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	month, err := time.Parse(monthLayout, strings.TrimSpace(monthStr))
+	if err != nil || month.After(today()) {
+		conn.Write([]byte("Invalid month, use YYYY-MM up to the current month\n"))
+		return
+	}
+
+	// Read the joint account from client, blank for the user's own account
+	joint, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading joint account", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	account := username
+	if joint = strings.TrimSpace(joint); joint != "" {
+		account = jointAccountKey(joint)
+		p, ok, err := getJointPermissions(account, username)
+		if err != nil {
+			log.Error("error getting joint permissions", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		if !ok || !p.View {
+			conn.Write([]byte("Permission denied\n"))
+			return
+		}
+	}
+
+	statement, paths, err := generateStatement(account, month)
+	if err != nil {
+		log.Error("error generating statement", "err", err)
+		conn.Write([]byte("Error generating statement\n"))
+		return
+	}
+
+	// Only complete months count as issued
+	if !month.AddDate(0, 1, 0).After(today()) {
+		if _, err := db.Exec("INSERT IGNORE INTO statements (account, month) VALUES (?, ?)", account, month.Format(monthLayout)); err != nil {
+			log.Error("error recording statement", "err", err)
+		}
+	}
+
+	// Send the summary, then both files for the client to save
+	c := statement.Currency
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "Statement %s: opening %s, closing %s, %d transactions, fees %s, interest %s\n",
+		month.Format(monthLayout), formatAmount(statement.Opening, c), formatAmount(statement.Closing, c), len(statement.Entries),
+		formatAmount(statement.Fees, c), formatAmount(statement.Interest, c))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Error("error reading statement file", "err", err)
+			conn.Write([]byte("Error reading statement file\n"))
+			return
+		}
+		writeFileBlock(&response, safeFileName(account)+"-"+filepath.Base(path), data)
+	}
+	conn.Write(response.Bytes())
+}
+
+// writeFileBlock sends a file inside a line-based response: a "FILE <name>"
+// line, the contents in base64 lines, then "END FILE"
+func writeFileBlock(w io.Writer, name string, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	fmt.Fprintf(w, "FILE %s\n", name)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	if encoded != "" {
+		fmt.Fprintf(w, "%s\n", encoded)
+	}
+	fmt.Fprint(w, "END FILE\n")
+}
+
+// statementRecipients returns who is told about a new statement: the owner,
+// or the owners of a joint account who can view it
+func statementRecipients(account string) ([]string, error) {
+	if !strings.HasPrefix(account, jointAccountKey("")) {
+		return []string{account}, nil
+	}
+	rows, err := db.Query("SELECT username FROM account_owners WHERE account = ? AND can_view = TRUE ORDER BY username", account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var owners []string
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, rows.Err()
+}
+
+func startStatementScheduler() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := runStatementJob(today()); err != nil {
+			logger.Error("error generating statements", "err", err)
+		}
+		finishOperation()
+		time.Sleep(statementInterval)
+	}
+}
+
+// runStatementJob issues last month's statement for every customer account
+// that does not have it yet, so a restart never issues one twice
+func runStatementJob(now time.Time) error {
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	monthStr := month.Format(monthLayout)
+
+	rows, err := db.Query("SELECT username FROM account WHERE account_type NOT IN ('revenue', 'loan') AND status <> 'closed' AND username NOT IN (SELECT account FROM statements WHERE month = ?)", monthStr)
+	if err != nil {
+		return err
+	}
+	var accounts []string
+	for rows.Next() {
+		var account string
+		if err := rows.Scan(&account); err != nil {
+			rows.Close()
+			return err
+		}
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if _, _, err := generateStatement(account, month); err != nil {
+			logger.Error("error generating statement", "account", account, "err", err)
+			continue
+		}
+		if _, err := db.Exec("INSERT IGNORE INTO statements (account, month) VALUES (?, ?)", account, monthStr); err != nil {
+			logger.Error("error recording statement", "account", account, "err", err)
+			continue
+		}
+		recipients, err := statementRecipients(account)
+		if err != nil {
+			logger.Error("error getting statement recipients", "account", account, "err", err)
+			continue
+		}
+		message := fmt.Sprintf("Your statement for %s is ready", monthStr)
+		if strings.HasPrefix(account, jointAccountKey("")) {
+			message = fmt.Sprintf("The statement of %s for %s is ready", strings.TrimPrefix(account, jointAccountKey("")), monthStr)
+		}
+		for _, recipient := range recipients {
+			if err := notifyUser(recipient, message); err != nil {
+				logger.Error("error notifying user", "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Push Notifications
+
+// Lines the server sends outside of a response start with pushPrefix, so the
+// client can tell them apart from the response it is waiting for
+const pushPrefix = "PUSH "
+
+var (
+	lowBalanceThreshold      = 100.0  // In the account's currency
+	largeWithdrawalThreshold = 1000.0 // In the account's currency
+)
+
+func addActiveSession(username string, conn net.Conn) {
+	activeUsersLock.Lock()
+	defer activeUsersLock.Unlock()
+	activeUsers[username] = append(activeUsers[username], conn)
+}
+
+func removeActiveSession(username string, conn net.Conn) {
+	activeUsersLock.Lock()
+	defer activeUsersLock.Unlock()
+	sessions := activeUsers[username]
+	for i, session := range sessions {
+		if session == conn {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(activeUsers, username)
+		return
+	}
+	activeUsers[username] = sessions
+}
+
+// pushWriteTimeout bounds a push to a client that is not reading, so it
+// cannot hold up the operation that sent the notification
+const pushWriteTimeout = 5 * time.Second
+
+// writePush sends one notification line. A single Write keeps it from being
+// interleaved with a response written by the session's own goroutine. The
+// write deadline is cleared afterwards; the session's read deadline still
+// ends idle connections.
+func writePush(conn net.Conn, message string) error {
+	conn.SetWriteDeadline(time.Now().Add(pushWriteTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write([]byte(pushPrefix + message + "\n"))
+	return err
+}
+
+// pushToUser sends a message to every open session of a user and reports
+// whether at least one of them received it
+func pushToUser(username, message string) bool {
+	activeUsersLock.Lock()
+	sessions := append([]net.Conn(nil), activeUsers[username]...)
+	activeUsersLock.Unlock()
+
+	delivered := false
+	for _, conn := range sessions {
+		if err := writePush(conn, message); err != nil {
+			logger.Error("error pushing notification", "err", err)
+			continue
+		}
+		delivered = true
+	}
+	return delivered
+}
+
+// announceTransfer tells the recipient about an incoming transfer and the
+// sender about a low balance. It is called once the transfer is committed.
+func announceTransfer(sender, recipient string, receipt TransferReceipt) {
+	message := fmt.Sprintf("You received %s from %s (reference %d)", formatAmount(receipt.CreditedAmount, receipt.CreditedCurrency), sender, receipt.ID)
+	if err := notifyUser(recipient, message); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+	checkLowBalance(sender, receipt.Available+receipt.Amount+receipt.Fee, receipt.Available, receipt.Currency)
+}
+
+// announceWithdrawal warns about large withdrawals and a low balance once the
+// withdrawal is committed
+func announceWithdrawal(username string, amount, fee, available float64, currency string) {
+	if amount >= largeWithdrawalThreshold {
+		if err := notifyUser(username, fmt.Sprintf("Large withdrawal of %s from your account", formatAmount(amount, currency))); err != nil {
+			logger.Error("error notifying user", "err", err)
+		}
+	}
+	checkLowBalance(username, available+amount+fee, available, currency)
+}
+
+// checkLowBalance notifies the user when a debit takes the available balance
+// below lowBalanceThreshold, once per crossing
+func checkLowBalance(username string, before, after float64, currency string) {
+	if before < lowBalanceThreshold || after >= lowBalanceThreshold {
+		return
+	}
+	if err := notifyUser(username, fmt.Sprintf("Low balance: %s available", formatAmount(after, currency))); err != nil {
+		logger.Error("error notifying user", "err", err)
+	}
+}
+
+// checkLoginAddress remembers the addresses a user logs in from and notifies
+// them of a login from an address never seen before. The very first login
+// is not reported.
+func checkLoginAddress(username string, addr net.Addr) error {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	var known, total int
+	err = db.QueryRow("SELECT COALESCE(SUM(address = ?), 0), COUNT(*) FROM login_addresses WHERE username = ?", host, username).Scan(&known, &total)
+	if err != nil {
+		return err
+	}
+	if known > 0 {
+		return nil
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO login_addresses (username, address) VALUES (?, ?)", username, host); err != nil {
+		return err
+	}
+	if total == 0 {
+		return nil
+	}
+	return notifyUser(username, fmt.Sprintf("New login to your account from %s", host))
+}
+
+// Alert Rules
+
+type AlertRule struct {
+	ID        int64
+	Kind      string // balance_below, debit_above or new_payee
+	Threshold sql.NullFloat64
+}
+
+var (
+	alertInterval  = 2 * time.Second
+	alertBatchSize = 500
+)
+
+func (r AlertRule) Describe(currency string) string {
+	switch r.Kind {
+	case "balance_below":
+		return "balance below " + formatAmount(r.Threshold.Float64, currency)
+	case "debit_above":
+		return "any debit above " + formatAmount(r.Threshold.Float64, currency)
+	}
+	return "transfer to a new payee"
+}
+
+func handleAddAlertRule(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read kind and threshold from client
+	fields := make([]string, 2)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading alert rule", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	rule := AlertRule{Kind: strings.ToLower(fields[0])}
+
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	switch rule.Kind {
+	case "balance_below", "debit_above":
+		threshold, err := parseAmount(fields[1], currency)
+		if err != nil {
+			conn.Write([]byte("Invalid threshold\n"))
+			return
+		}
+		rule.Threshold = sql.NullFloat64{Float64: threshold, Valid: true}
+	case "new_payee":
+	default:
+		conn.Write([]byte("Invalid alert kind, use balance_below, debit_above or new_payee\n"))
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO alert_rules (username, kind, threshold) VALUES (?, ?, ?)", username, rule.Kind, rule.Threshold)
+	if err != nil {
+		log.Error("error inserting alert rule", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error("error inserting alert rule", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Alert %d created: %s\n", id, rule.Describe(currency))))
+}
+
+func loadAlertRules(username string) ([]AlertRule, error) {
+	rows, err := db.Query("SELECT id, kind, threshold FROM alert_rules WHERE username = ? ORDER BY id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		var rule AlertRule
+		if err := rows.Scan(&rule.ID, &rule.Kind, &rule.Threshold); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func handleListAlertRules(conn net.Conn, log *slog.Logger, username string) {
+	currency, err := getAccountCurrency(username)
+	if err != nil {
+		log.Error("error getting account currency", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	rules, err := loadAlertRules(username)
+	if err != nil {
+		log.Error("error querying alert rules", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	var message string
+	for _, rule := range rules {
+		message += fmt.Sprintf("#%d: %s\n", rule.ID, rule.Describe(currency))
+	}
+	if message == "" {
+		message = "No alerts\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleRemoveAlertRule(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read alert ID from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading alert ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid alert ID\n"))
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM alert_rules WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		log.Error("error removing alert rule", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		conn.Write([]byte("Alert not found\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("Alert %d removed\n", id)))
+}
+
+// startAlertEvaluator checks every committed ledger entry against the alert
+// rules of its account. Entries are picked up through their alerts_evaluated
+// flag, so whichever code path posted them and whenever it committed, each
+// one is evaluated, including after a restart.
+func startAlertEvaluator() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := evaluateAlerts(); err != nil {
+			logger.Error("error evaluating alerts", "err", err)
+		}
+		finishOperation()
+		time.Sleep(alertInterval)
+	}
+}
+
+func evaluateAlerts() error {
+	rows, err := db.Query("SELECT id, username, type, amount, currency, counterparty FROM transactions WHERE alerts_evaluated = FALSE ORDER BY id LIMIT ?", alertBatchSize)
+	if err != nil {
+		return err
+	}
+	var entries []LedgerEntry
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var entry LedgerEntry
+		if err := rows.Scan(&id, &entry.Username, &entry.Type, &entry.Amount, &entry.Currency, &entry.Counterparty); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rules := make(map[string][]AlertRule)
+	for i, entry := range entries {
+		userRules, ok := rules[entry.Username]
+		if !ok {
+			if userRules, err = loadAlertRules(entry.Username); err != nil {
+				return err
+			}
+			rules[entry.Username] = userRules
+		}
+
+		// Every rule is checked before anything is sent, and the entry is
+		// flagged right before its alerts go out, so an error cannot leave
+		// an entry whose alerts were sent to be evaluated again
+		var messages []string
+		for _, rule := range userRules {
+			message, err := checkAlertRule(rule, ids[i], entry)
+			if err != nil {
+				return err
+			}
+			if message != "" {
+				messages = append(messages, message)
+			}
+		}
+
+		if _, err := db.Exec("UPDATE transactions SET alerts_evaluated = TRUE WHERE id = ?", ids[i]); err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err := notifyUser(entry.Username, "Alert: "+message); err != nil {
+				logger.Error("error notifying user", "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAlertRule returns the alert message when ledger entry id triggers the
+// rule, or an empty string
+func checkAlertRule(rule AlertRule, id int64, entry LedgerEntry) (string, error) {
+	switch rule.Kind {
+	case "debit_above":
+		if -entry.Amount > rule.Threshold.Float64 {
+			return fmt.Sprintf("debit of %s (%s, reference %d)", formatAmount(-entry.Amount, entry.Currency), entry.Type, id), nil
+		}
+
+	case "balance_below":
+		if entry.Amount >= 0 {
+			return "", nil
+		}
+		// The balance right after this entry, whatever was posted since
+		var balance, later float64
+		if err := db.QueryRow("SELECT balance FROM account WHERE username = ?", entry.Username).Scan(&balance); err != nil {
+			return "", err
+		}
+		if err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE username = ? AND id > ?", entry.Username, id).Scan(&later); err != nil {
+			return "", err
+		}
+		after := balance - later
+		if after-entry.Amount >= rule.Threshold.Float64 && after < rule.Threshold.Float64 {
+			return fmt.Sprintf("balance fell below %s, now %s after %s (reference %d)",
+				formatAmount(rule.Threshold.Float64, entry.Currency), formatAmount(after, entry.Currency), entry.Type, id), nil
+		}
+
+	case "new_payee":
+		if entry.Type != "transfer_out" {
+			return "", nil
+		}
+		var earlier int
+		err := db.QueryRow("SELECT COUNT(*) FROM transactions WHERE username = ? AND type = 'transfer_out' AND counterparty = ? AND id < ?", entry.Username, entry.Counterparty, id).Scan(&earlier)
+		if err != nil {
+			return "", err
+		}
+		if earlier == 0 {
+			return fmt.Sprintf("first transfer to %s: %s (reference %d)", entry.Counterparty, formatAmount(-entry.Amount, entry.Currency), id), nil
+		}
+	}
+	return "", nil
+}
+
+// Webhooks
+
+// AccountEvent describes a committed deposit, withdrawal or transfer. Its
+// JSON is the body posted to webhook endpoints and the data of outbox events.
+// ID is the ledger entry of the operation, so receivers can drop duplicates.
+type AccountEvent struct {
+	ID               int64   `json:"id"`
+	Type             string  `json:"type"` // deposit, withdraw or transfer
+	Account          string  `json:"account"`
+	Amount           float64 `json:"amount"`
+	Currency         string  `json:"currency"`
+	Fee              float64 `json:"fee,omitempty"`
+	Counterparty     string  `json:"counterparty,omitempty"`
+	CreditedAmount   float64 `json:"credited_amount,omitempty"`
+	CreditedCurrency string  `json:"credited_currency,omitempty"`
+	OccurredAt       string  `json:"occurred_at"`
+}
+
+var (
+	webhookInterval    = time.Second
+	webhookBatchSize   = 100
+	webhookMaxAttempts = 8
+	webhookRetryBase   = 30 * time.Second
+	webhookRetryMax    = 6 * time.Hour
+	webhookClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+var webhookEventTypes = map[string]bool{"deposit": true, "withdraw": true, "transfer": true}
+
+// recordAccountEvent appends the event to the outbox and queues its webhook
+// deliveries, inside the transaction that changes the balance. Neither is
+// ever sent unless that transaction commits.
+func recordAccountEvent(tx *sql.Tx, event AccountEvent) error {
+	event.OccurredAt = time.Now().UTC().Format(time.RFC3339)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_events (event_type, account, payload) VALUES (?, ?, ?)", event.Type, event.Account, payload)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, event.Type, payload)
+}
+
+// enqueueWebhooks writes one delivery per interested endpoint into the
+// webhook outbox
+func enqueueWebhooks(tx *sql.Tx, eventType string, payload []byte) error {
+	_, err := tx.Exec("INSERT INTO webhook_deliveries (webhook_id, event_type, payload, next_attempt_at) SELECT id, ?, ?, ? FROM webhooks WHERE active = TRUE AND (events = '*' OR FIND_IN_SET(?, events) > 0)",
+		eventType, payload, time.Now().UTC(), eventType)
+	return err
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.payload" with the
+// endpoint's secret. Including the timestamp lets receivers reject replays.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireAdmin answers Permission denied for non-admins
+func requireAdmin(conn net.Conn, log *slog.Logger, username string) bool {
+	admin, err := isAdmin(username)
+	if err != nil {
+		log.Error("error checking admin", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return false
+	}
+	if !admin {
+		conn.Write([]byte("Permission denied\n"))
+		return false
+	}
+	return true
+}
+
+func handleRegisterWebhook(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read URL and event types from client
+	fields := make([]string, 2)
+	for i := range fields {
+		field, err := reader.ReadString('\n')
+		if err != nil {
+			log.Error("error reading webhook", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		fields[i] = strings.TrimSpace(field)
+	}
+	url, events := fields[0], strings.ToLower(strings.ReplaceAll(fields[1], " ", ""))
+
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		conn.Write([]byte("Invalid URL\n"))
+		return
+	}
+	if events == "" {
+		events = "*"
+	}
+	if events != "*" {
+		for _, event := range strings.Split(events, ",") {
+			if !webhookEventTypes[event] {
+				conn.Write([]byte("Invalid event type, use deposit, withdraw, transfer or *\n"))
+				return
+			}
+		}
+	}
+
+	// The secret is only shown once, at registration
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		log.Error("error generating webhook secret", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	result, err := db.Exec("INSERT INTO webhooks (url, secret, events, created_by) VALUES (?, ?, ?, ?)", url, secret, events, username)
+	if err != nil {
+		log.Error("error inserting webhook", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error("error inserting webhook", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	auditConn(conn, log, username, "webhook_register", "success", fmt.Sprintf("webhook %d: %s for %s", id, url, events))
+	conn.Write([]byte(fmt.Sprintf("Webhook %d registered for %s. Signing secret: %s\n", id, events, secret)))
+}
+
+func handleListWebhooks(conn net.Conn, log *slog.Logger, username string) {
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+
+	rows, err := db.Query("SELECT w.id, w.url, w.events, (SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.status = 'pending'), (SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.status = 'dead') FROM webhooks w WHERE w.active = TRUE ORDER BY w.id")
+	if err != nil {
+		log.Error("error querying webhooks", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var id int64
+		var url, events string
+		var pending, dead int
+		if err := rows.Scan(&id, &url, &events, &pending, &dead); err != nil {
+			log.Error("error reading webhook", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("#%d: %s (%s), %d pending, %d failed\n", id, url, events, pending, dead)
+	}
+	if message == "" {
+		message = "No webhooks\n"
+	}
+	conn.Write([]byte(message))
+}
+
+func handleRemoveWebhook(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read webhook ID from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading webhook ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		conn.Write([]byte("Invalid webhook ID\n"))
+		return
+	}
+
+	// Deliveries still queued are dropped with the endpoint
+	result, err := db.Exec("UPDATE webhooks SET active = FALSE WHERE id = ? AND active = TRUE", id)
+	if err != nil {
+		log.Error("error removing webhook", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		conn.Write([]byte("Webhook not found\n"))
+		return
+	}
+	auditConn(conn, log, username, "webhook_remove", "success", fmt.Sprintf("webhook %d", id))
+	conn.Write([]byte(fmt.Sprintf("Webhook %d removed\n", id)))
+}
+
+// handleListDeadWebhooks shows the dead-letter list: deliveries that failed
+// every attempt
+func handleListDeadWebhooks(conn net.Conn, log *slog.Logger, username string) {
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+
+	rows, err := db.Query("SELECT d.id, d.webhook_id, d.event_type, d.attempts, d.last_error FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.status = 'dead' AND w.active = TRUE ORDER BY d.id")
+	if err != nil {
+		log.Error("error querying webhook deliveries", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	var message string
+	for rows.Next() {
+		var id, webhookID int64
+		var eventType string
+		var attempts int
+		var lastError sql.NullString
+		if err := rows.Scan(&id, &webhookID, &eventType, &attempts, &lastError); err != nil {
+			log.Error("error reading webhook delivery", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("#%d: %s to webhook %d, %d attempts, last error: %s\n", id, eventType, webhookID, attempts, lastError.String)
+	}
+	if message == "" {
+		message = "No failed deliveries\n"
+	}
+	conn.Write([]byte(message))
+}
+
+// handleRetryWebhook puts a dead delivery, or all of them with "all", back in the queue
+func handleRetryWebhook(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read delivery ID from client
+	idStr, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading delivery ID", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+	idStr = strings.TrimSpace(idStr)
+
+	var result sql.Result
+	if strings.EqualFold(idStr, "all") {
+		result, err = db.Exec("UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = ? WHERE status = 'dead'", time.Now().UTC())
+	} else {
+		id, parseErr := strconv.ParseInt(idStr, 10, 64)
+		if parseErr != nil {
+			conn.Write([]byte("Invalid delivery ID\n"))
+			return
+		}
+		result, err = db.Exec("UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = ? WHERE id = ? AND status = 'dead'", time.Now().UTC(), id)
+	}
+	if err != nil {
+		log.Error("error retrying webhook delivery", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		conn.Write([]byte("No failed delivery found\n"))
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("%d deliveries queued again\n", affected)))
+}
+
+func startWebhookDispatcher() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		if err := dispatchWebhooks(time.Now().UTC()); err != nil {
+			logger.Error("error dispatching webhooks", "err", err)
+		}
+		finishOperation()
+		time.Sleep(webhookInterval)
+	}
+}
+
+type webhookDelivery struct {
+	ID        int64
+	URL       string
+	Secret    string
+	EventType string
+	Payload   []byte
+	Attempts  int
+}
+
+// dispatchWebhooks sends the deliveries that are due. A delivery is marked
+// delivered only after a 2xx answer, so endpoints may see an event more than once.
+func dispatchWebhooks(now time.Time) error {
+	rows, err := db.Query("SELECT d.id, w.url, w.secret, d.event_type, d.payload, d.attempts FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.status = 'pending' AND w.active = TRUE AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?",
+		now, webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.ID, &d.URL, &d.Secret, &d.EventType, &d.Payload, &d.Attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		outcome := attemptWebhook(d)
+		if outcome.Status == "delivered" {
+			if _, err := db.Exec("UPDATE webhook_deliveries SET status = 'delivered', attempts = ?, delivered_at = ? WHERE id = ?", outcome.Attempts, time.Now().UTC(), d.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if outcome.Status == "pending" {
+			metrics.CountRetry("webhook")
+		}
+		_, err := db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+			outcome.Status, outcome.Attempts, time.Now().UTC().Add(outcome.Delay), truncate(outcome.Err.Error(), 255), d.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookOutcome is the state of a delivery after one attempt
+type webhookOutcome struct {
+	Status   string // delivered, pending or dead
+	Attempts int
+	Delay    time.Duration // Until the next attempt, when pending
+	Err      error
+}
+
+// attemptWebhook sends a delivery once and works out what happens next
+func attemptWebhook(d webhookDelivery) webhookOutcome {
+	outcome := webhookOutcome{Status: "delivered", Attempts: d.Attempts + 1}
+	if outcome.Err = sendWebhook(d); outcome.Err == nil {
+		return outcome
+	}
+	outcome.Status, outcome.Delay = webhookBackoff(outcome.Attempts)
+	return outcome
+}
+
+// webhookBackoff returns the status of a delivery after attempts failed
+// attempts and the delay before the next one: it backs off exponentially,
+// then gives up into the dead-letter list
+func webhookBackoff(attempts int) (string, time.Duration) {
+	if attempts >= webhookMaxAttempts {
+		return "dead", 0
+	}
+	delay := webhookRetryBase * time.Duration(1<<uint(attempts-1))
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return "pending", delay
+}
+
+func sendWebhook(d webhookDelivery) error {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(d.Secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// truncate shortens s to at most max characters, cutting on rune boundaries
+// so multi-byte characters are never split.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+	return s
+}
+
+// Event Stream
+
+// OutboxEvent is one event of the stream as published to the sinks. IDs are
+// increasing, consumers use them to track their position and drop repeats.
+type OutboxEvent struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"`
+	Account    string          `json:"account"`
+	OccurredAt string          `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// EventSink is where the relay publishes the event stream. Publish must only
+// return nil once the event is durably handed over.
+type EventSink interface {
+	Name() string // Also the consumer name its offset is stored under
+	Publish(event OutboxEvent) error
+}
+
+var (
+	eventSinks          = "file:events.jsonl" // Comma-separated, overridden by BANK_EVENT_SINKS
+	outboxInterval      = time.Second
+	outboxBatchSize     = 500
+	outboxGapTimeout    = 60    // Seconds to wait for an event ID still being committed
+	outboxSkipRetention = 86400 // Seconds a skipped event ID is rechecked before it is given up
+)
+
+// parseEventSinks reads a sink list such as
+// "stdout,file:events.jsonl,redis:localhost:6379/bank-events"
+func parseEventSinks(list string) ([]EventSink, error) {
+	var sinks []EventSink
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		kind, arg, _ := strings.Cut(spec, ":")
+		switch {
+		case spec == "" || spec == "none":
+		case kind == "stdout":
+			sinks = append(sinks, stdoutSink{})
+		case kind == "file" && arg != "":
+			sinks = append(sinks, &fileSink{path: arg})
+		case kind == "redis" && arg != "":
+			addr, stream, ok := strings.Cut(arg, "/")
+			if !ok || stream == "" {
+				return nil, fmt.Errorf("redis sink needs host:port/stream: %s", spec)
+			}
+			sinks = append(sinks, &redisSink{addr: addr, stream: stream})
+		default:
+			return nil, fmt.Errorf("unknown event sink: %s", spec)
+		}
+	}
+	return sinks, nil
+}
+
+// stdoutSink prints every event as a JSON line
+type stdoutSink struct{}
+
+func (stdoutSink) Name() string { return "stdout" }
+
+func (stdoutSink) Publish(event OutboxEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(line))
+	return err
+}
+
+// fileSink appends every event as a JSON line and syncs it to disk
+type fileSink struct {
+	path string
+	file *os.File
+}
+
+func (s *fileSink) Name() string { return "file:" + s.path }
+
+func (s *fileSink) Publish(event OutboxEvent) error {
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// redisSink adds every event to a Redis stream with XADD, speaking the
+// Redis protocol directly
+type redisSink struct {
+	addr   string
+	stream string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *redisSink) Name() string { return "redis:" + s.addr + "/" + s.stream }
+
+func (s *redisSink) Publish(event OutboxEvent) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+	}
+	err := s.xadd(event)
+	if err != nil {
+		// Reconnect on the next attempt
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *redisSink) xadd(event OutboxEvent) error {
+	args := []string{"XADD", s.stream, "*", "id", strconv.FormatInt(event.ID, 10), "type", event.Type, "account", event.Account, "occurred_at", event.OccurredAt, "data", string(event.Data)}
+	var command bytes.Buffer
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(command.Bytes()); err != nil {
+		return err
+	}
+
+	// The reply is the entry ID as a bulk string, or an error
+	reply, err := s.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(reply, "-"):
+		return fmt.Errorf("redis: %s", strings.TrimSpace(reply[1:]))
+	case strings.HasPrefix(reply, "$"):
+		_, err = s.reader.ReadString('\n')
+		return err
+	}
+	return fmt.Errorf("redis: unexpected reply %q", reply)
+}
+
+func startOutboxRelay(sink EventSink) {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		late, err := relaySkippedEvents(sink)
+		if err != nil {
+			logger.Error("error relaying skipped events", "sink", sink.Name(), "err", err)
+		}
+		published, err := relayOutbox(sink)
+		if err != nil {
+			logger.Error("error relaying events", "sink", sink.Name(), "err", err)
+		}
+		finishOperation()
+		if late+published == 0 {
+			time.Sleep(outboxInterval)
+		}
+	}
+}
+
+// relayOutbox publishes the events after the sink's offset, in order, and
+// moves the offset after each one. An event is published again if the
+// process stops between both steps, so delivery is at least once.
+//
+// IDs are assigned at insert but become visible at commit, so a missing ID
+// may still show up. The relay waits for it, unless the events after it are
+// older than outboxGapTimeout. It then skips the ID, most likely rolled back,
+// and records it in outbox_skipped for relaySkippedEvents to recheck.
+func relayOutbox(sink EventSink) (int, error) {
+	consumer := sink.Name()
+	if _, err := db.Exec("INSERT IGNORE INTO outbox_offsets (consumer, last_event_id) VALUES (?, 0)", consumer); err != nil {
+		return 0, err
+	}
+	var offset int64
+	if err := db.QueryRow("SELECT last_event_id FROM outbox_offsets WHERE consumer = ?", consumer).Scan(&offset); err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query("SELECT id, event_type, account, payload, TIMESTAMPDIFF(SECOND, created_at, NOW()) FROM outbox_events WHERE id > ? ORDER BY id LIMIT ?", offset, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		event OutboxEvent
+		age   int
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		var payload []byte
+		if err := rows.Scan(&p.event.ID, &p.event.Type, &p.event.Account, &payload, &p.age); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		p.event.Data = payload
+		events = append(events, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, p := range events {
+		if p.event.ID != offset+1 && p.age < outboxGapTimeout {
+			break
+		}
+		for id := offset + 1; id < p.event.ID; id++ {
+			logger.Warn("skipping missing outbox event", "sink", consumer, "id", id)
+			if _, err := db.Exec("INSERT IGNORE INTO outbox_skipped (consumer, event_id) VALUES (?, ?)", consumer, id); err != nil {
+				return published, err
+			}
+		}
+		var data AccountEvent
+		if err := json.Unmarshal(p.event.Data, &data); err == nil {
+			p.event.OccurredAt = data.OccurredAt
+		}
+		if err := sink.Publish(p.event); err != nil {
+			return published, err
+		}
+		if _, err := db.Exec("UPDATE outbox_offsets SET last_event_id = ? WHERE consumer = ?", p.event.ID, consumer); err != nil {
+			return published, err
+		}
+		offset = p.event.ID
+		published++
+	}
+	return published, nil
+}
+
+// relaySkippedEvents publishes the skipped event IDs of a sink that have
+// shown up since, out of order, and gives up on the ones skipped longer than
+// outboxSkipRetention ago
+func relaySkippedEvents(sink EventSink) (int, error) {
+	consumer := sink.Name()
+	rows, err := db.Query("SELECT event_id FROM outbox_skipped WHERE consumer = ? AND skipped_at < NOW() - INTERVAL ? SECOND", consumer, outboxSkipRetention)
+	if err != nil {
+		return 0, err
+	}
+	var expired []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		logger.Warn("giving up on skipped outbox event", "sink", consumer, "id", id)
+		if _, err := db.Exec("DELETE FROM outbox_skipped WHERE consumer = ? AND event_id = ?", consumer, id); err != nil {
+			return 0, err
+		}
+	}
+
+	rows, err = db.Query("SELECT e.id, e.event_type, e.account, e.payload FROM outbox_skipped s JOIN outbox_events e ON e.id = s.event_id WHERE s.consumer = ? ORDER BY e.id", consumer)
+	if err != nil {
+		return 0, err
+	}
+	var events []OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.Type, &event.Account, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		event.Data = payload
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, event := range events {
+		var data AccountEvent
+		if err := json.Unmarshal(event.Data, &data); err == nil {
+			event.OccurredAt = data.OccurredAt
+		}
+		if err := sink.Publish(event); err != nil {
+			return published, err
+		}
+		logger.Info("published skipped outbox event", "sink", consumer, "id", event.ID)
+		if _, err := db.Exec("DELETE FROM outbox_skipped WHERE consumer = ? AND event_id = ?", consumer, event.ID); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+func handleEventStreamStatus(conn net.Conn, log *slog.Logger, username string) {
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+
+	var last int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM outbox_events").Scan(&last); err != nil {
+		log.Error("error querying outbox", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	rows, err := db.Query("SELECT consumer, last_event_id FROM outbox_offsets ORDER BY consumer")
+	if err != nil {
+		log.Error("error querying consumer offsets", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	defer rows.Close()
+
+	message := fmt.Sprintf("Last event: %d\n", last)
+	for rows.Next() {
+		var consumer string
+		var offset int64
+		if err := rows.Scan(&consumer, &offset); err != nil {
+			log.Error("error reading consumer offset", "err", err)
+			conn.Write([]byte("Internal server error\n"))
+			return
+		}
+		message += fmt.Sprintf("%s: at %d, %d behind\n", consumer, offset, last-offset)
+	}
+	conn.Write([]byte(message))
+}
+
+// Event-Sourced Accounts
+
+// AccountAggregate is the state of an account rebuilt from its event stream
+type AccountAggregate struct {
+	Account string
+	Version int64
+	Balance float64
+}
+
+// AccountStreamEvent is one event of an account's stream. Every ledger entry
+// of the account is an event, numbered from 1 without gaps.
+type AccountStreamEvent struct {
+	Version      int64
+	Type         string
+	Amount       float64
+	Currency     string
+	Counterparty string
+	LedgerID     int64
+}
+
+func (a *AccountAggregate) Apply(event AccountStreamEvent) {
+	a.Balance += event.Amount
+	a.Version = event.Version
+}
+
+var (
+	eventSourced     bool  // Set from BANK_EVENT_SOURCED
+	snapshotInterval int64 = 50
+)
+
+// StreamDriftError is returned when an account's row, its stream and its
+// ledger disagree in a way the ledger does not explain. Nothing is posted to
+// the account until an admin has looked into it.
+type StreamDriftError struct {
+	Account   string
+	Currency  string
+	Projected float64
+	Stream    float64
+	Ledger    float64
+}
+
+func (e *StreamDriftError) Error() string {
+	return fmt.Sprintf("account %s has %s, its stream %s and its ledger %s", e.Account,
+		formatAmount(e.Projected, e.Currency), formatAmount(e.Stream, e.Currency), formatAmount(e.Ledger, e.Currency))
+}
+
+// loadAggregate rebuilds an account from its latest snapshot and the events
+// after it. It reports false when the account has no stream yet.
+func loadAggregate(tx *sql.Tx, account string) (AccountAggregate, bool, error) {
+	aggregate := AccountAggregate{Account: account}
+	err := tx.QueryRow("SELECT version, balance FROM account_snapshots WHERE account = ? ORDER BY version DESC LIMIT 1", account).
+		Scan(&aggregate.Version, &aggregate.Balance)
+	if err == sql.ErrNoRows {
+		return aggregate, false, nil
+	}
+	if err != nil {
+		return aggregate, false, err
+	}
+
+	rows, err := tx.Query("SELECT version, type, amount, currency, counterparty, ledger_id FROM account_events WHERE account = ? AND version > ? ORDER BY version", account, aggregate.Version)
+	if err != nil {
+		return aggregate, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AccountStreamEvent
+		if err := rows.Scan(&event.Version, &event.Type, &event.Amount, &event.Currency, &event.Counterparty, &event.LedgerID); err != nil {
+			return aggregate, false, err
+		}
+		if event.Version != aggregate.Version+1 {
+			return aggregate, false, fmt.Errorf("stream of %s jumps from version %d to %d", account, aggregate.Version, event.Version)
+		}
+		aggregate.Apply(event)
+	}
+	return aggregate, true, rows.Err()
+}
+
+// syncAccountStream locks an account, loads its aggregate and makes the
+// account row its projection. The row lock serializes writers of the stream.
+//
+// When the row and the stream disagree, the ledger decides: ledgered changes
+// made while event sourcing was off are reconciled into the stream, and a row
+// changed by hand is repaired from the stream. Any other drift is refused with
+// a StreamDriftError. An account without a stream starts one from its ledger
+// balance. It returns what was changed, or an empty string.
+func syncAccountStream(tx *sql.Tx, account string) (AccountAggregate, string, error) {
+	var projected float64
+	var version int64
+	var currency string
+	err := tx.QueryRow("SELECT balance, version, currency FROM account WHERE username = ? FOR UPDATE", account).Scan(&projected, &version, &currency)
+	if err != nil {
+		return AccountAggregate{}, "", err
+	}
+	aggregate, found, err := loadAggregate(tx, account)
+	if err != nil {
+		return aggregate, "", err
+	}
+
+	var change string
+	switch {
+	case !found:
+		ledger, err := ledgerBalance(tx, account)
+		if err != nil {
+			return aggregate, "", err
+		}
+		if roundToMinorUnits(ledger, currency) != roundToMinorUnits(projected, currency) {
+			return aggregate, "", &StreamDriftError{Account: account, Currency: currency, Projected: projected, Stream: ledger, Ledger: ledger}
+		}
+		_, err = tx.Exec("INSERT INTO account_snapshots (account, version, balance) VALUES (?, 0, ?)", account, ledger)
+		if err != nil {
+			return aggregate, "", err
+		}
+		aggregate.Balance = ledger
+		change = "stream started from the ledger"
+
+	case roundToMinorUnits(projected, currency) != roundToMinorUnits(aggregate.Balance, currency):
+		ledger, err := ledgerBalance(tx, account)
+		if err != nil {
+			return aggregate, "", err
+		}
+		switch roundToMinorUnits(ledger, currency) {
+		case roundToMinorUnits(projected, currency):
+			// The stream missed ledgered changes
+			if err := reconcileStream(tx, &aggregate, ledger, currency); err != nil {
+				return aggregate, "", err
+			}
+			change = "stream reconciled to the ledger"
+		case roundToMinorUnits(aggregate.Balance, currency):
+			// The row was changed outside the ledger
+			logger.Warn("account projection changed outside its stream, repaired", "account", account, "version", aggregate.Version, "balance", projected)
+			change = fmt.Sprintf("projection repaired from %s", formatAmount(projected, currency))
+		default:
+			return aggregate, "", &StreamDriftError{Account: account, Currency: currency, Projected: projected, Stream: aggregate.Balance, Ledger: ledger}
+		}
+
+	case version != aggregate.Version:
+		change = fmt.Sprintf("projection version repaired from %d", version)
+
+	default:
+		return aggregate, "", nil
+	}
+
+	_, err = tx.Exec("UPDATE account SET balance = ?, version = ? WHERE username = ?", aggregate.Balance, aggregate.Version, account)
+	if err != nil {
+		return aggregate, "", err
+	}
+
+	// The balance may have changed without a ledger entry, so it is audited here
+	err = insertAudit(tx, AuditEntry{
+		Actor:         "system",
+		Action:        "stream.sync",
+		Account:       account,
+		BalanceBefore: sql.NullString{String: fmt.Sprintf("%.4f", projected), Valid: true},
+		BalanceAfter:  sql.NullString{String: fmt.Sprintf("%.4f", aggregate.Balance), Valid: true},
+		Outcome:       "posted",
+		Detail:        change,
+	})
+	return aggregate, change, err
+}
+
+// lockAccountStream syncs an account in event-sourced mode before its balance
+// is read for a funds check, so the check is made against the stream
+func lockAccountStream(tx *sql.Tx, account string) error {
+	if !eventSourced {
+		return nil
+	}
+	_, _, err := syncAccountStream(tx, account)
+	return err
+}
+
+// appendAccountEvent appends a ledger entry to its account's stream and
+// projects the new state into the account table, inside tx. The aggregate
+// comes from syncAccountStream, called before the entry was ledgered.
+func appendAccountEvent(tx *sql.Tx, aggregate *AccountAggregate, entry LedgerEntry, ledgerID int64) error {
+	version := aggregate.Version
+	event := AccountStreamEvent{
+		Version:      aggregate.Version + 1,
+		Type:         entry.Type,
+		Amount:       entry.Amount,
+		Currency:     entry.Currency,
+		Counterparty: entry.Counterparty,
+		LedgerID:     ledgerID,
+	}
+	if err := appendStreamEvent(tx, aggregate, event); err != nil {
+		return err
+	}
+
+	// The account table is only written as the projection of the aggregate
+	_, err := tx.Exec("UPDATE account SET balance = ?, version = ? WHERE username = ?", aggregate.Balance, aggregate.Version, entry.Username)
+	if err != nil {
+		return err
+	}
+
+	// Snapshot regularly so loading never replays more than snapshotInterval events
+	if aggregate.Version/snapshotInterval > version/snapshotInterval {
+		_, err = tx.Exec("INSERT INTO account_snapshots (account, version, balance) VALUES (?, ?, ?)", entry.Username, aggregate.Version, aggregate.Balance)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendStreamEvent writes the aggregate's next event and applies it
+func appendStreamEvent(tx *sql.Tx, aggregate *AccountAggregate, event AccountStreamEvent) error {
+	_, err := tx.Exec("INSERT INTO account_events (account, version, type, amount, currency, counterparty, ledger_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		aggregate.Account, event.Version, event.Type, event.Amount, event.Currency, event.Counterparty, event.LedgerID)
+	if err != nil {
+		return err
+	}
+	aggregate.Apply(event)
+	return nil
+}
+
+// reconcileStream brings the aggregate to the ledger balance with a
+// "reconciliation" event for the difference. It has no ledger entry of its
+// own: the changes it stands for were ledgered when they were made.
+func reconcileStream(tx *sql.Tx, aggregate *AccountAggregate, ledger float64, currency string) error {
+	logger.Warn("account stream missed ledgered changes, reconciled", "account", aggregate.Account, "version", aggregate.Version, "stream_balance", aggregate.Balance, "balance", ledger)
+	event := AccountStreamEvent{
+		Version:  aggregate.Version + 1,
+		Type:     "reconciliation",
+		Amount:   ledger - aggregate.Balance,
+		Currency: currency,
+	}
+	return appendStreamEvent(tx, aggregate, event)
+}
+
+// ledgerBalance sums an account's ledger entries, which is its balance if
+// every change since it was opened was ledgered
+func ledgerBalance(q queryRower, account string) (float64, error) {
+	var balance float64
+	err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE username = ?", account).Scan(&balance)
+	return balance, err
+}
+
+// handleRebuildAccount rebuilds an account from its stream and brings its
+// projection in line with syncAccountStream, which reports what it changed
+// or the drift it refused
+func handleRebuildAccount(conn net.Conn, log *slog.Logger, reader *bufio.Reader, username string) {
+	// Read account from client
+	account, err := reader.ReadString('\n')
+	if err != nil {
+		log.Error("error reading account", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	account = strings.TrimSpace(account)
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+
+	currency, err := getAccountCurrency(account)
+	if err == sql.ErrNoRows {
+		conn.Write([]byte("Account not found\n"))
+		return
+	}
+	if err != nil {
+		log.Error("error reading account", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("error starting transaction", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	aggregate, change, err := syncAccountStream(tx, account)
+	var driftErr *StreamDriftError
+	if errors.As(err, &driftErr) {
+		_ = tx.Rollback()
+		auditConnAccount(conn, log, username, "rebuild_account", account, "refused", driftErr.Error())
+		conn.Write([]byte(fmt.Sprintf("%s: nothing changed, investigate before repairing\n", driftErr.Error())))
+		return
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.Error("error rebuilding account", "err", err)
+		conn.Write([]byte("Error loading account stream\n"))
+		return
+	}
+
+	message := fmt.Sprintf("%s rebuilt at version %d: %s", account, aggregate.Version, formatAmount(aggregate.Balance, currency))
+	if change == "" {
+		_ = tx.Rollback()
+		conn.Write([]byte(message + ", projection is up to date\n"))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("error repairing projection", "err", err)
+		conn.Write([]byte("Internal server error\n"))
+		return
+	}
+	auditConnAccount(conn, log, username, "rebuild_account", account, "success", change)
+	conn.Write([]byte(message + ", " + change + "\n"))
+}
+
+// Audit Log
+
+// AuditEntry is one row of the append-only audit log. Balances are only set
+// for balance changes.
+type AuditEntry struct {
+	ID            int64
+	CreatedAt     string
+	Actor         string
+	RemoteAddr    string
+	Action        string
+	Account       string
+	BalanceBefore sql.NullString
+	BalanceAfter  sql.NullString
+	Outcome       string
+	Detail        string
+	Seq           int64  `json:"-"`
+	PrevHash      string `json:"-"`
+	Hash          string `json:"-"`
+}
+
+// ChainHash links an entry to the one sealed before it. It covers every
+// column as stored, so changing, removing or reordering sealed entries
+// breaks the chain from that point on.
+func (e AuditEntry) ChainHash(seq int64, prevHash string) (string, error) {
+	fields, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%s", seq, prevHash, fields)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var (
+	auditSealInterval = 2 * time.Second
+	auditSealBatch    = 500
+	auditSealGrace    = 60 // Seconds after which an unsealed entry is reported
+)
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertAudit(q execer, e AuditEntry) error {
+	_, err := q.Exec("INSERT INTO audit_log (actor, remote_addr, action, account, balance_before, balance_after, outcome, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Actor, e.RemoteAddr, e.Action, e.Account, e.BalanceBefore, e.BalanceAfter, e.Outcome, e.Detail)
+	return err
+}
+
+// auditConn records a request made over a client connection on the actor's
+// own account. Failing to audit is logged but does not fail the request,
+// which has already run.
+func auditConn(conn net.Conn, log *slog.Logger, actor, action, outcome, detail string) {
+	auditConnAccount(conn, log, actor, action, actor, outcome, detail)
+}
+
+// auditConnAccount records a request made over a client connection that acts
+// on account, such as an admin action on someone else's account
+func auditConnAccount(conn net.Conn, log *slog.Logger, actor, action, account, outcome, detail string) {
+	entry := AuditEntry{
+		Actor:      actor,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Action:     action,
+		Account:    account,
+		Outcome:    outcome,
+		Detail:     detail,
+	}
+	level := slog.LevelInfo
+	if outcome != "success" {
+		level = slog.LevelWarn
+	}
+	log.Log(context.Background(), level, "audit", "actor", actor, "action", action, "account", account, "outcome", outcome)
+	if err := insertAudit(db, entry); err != nil {
+		log.Error("error writing audit log", "err", err)
+	}
+}
+
+func auditOutcome(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return "success"
+}
+
+// auditLedgerEntry records a balance change in the transaction that makes it,
+// so the audit log holds every committed change and nothing rolled back. The
+// account's balance update has already been applied when its entry is recorded.
+// The actor is whoever initiated the change, which for an admin reversal, a
+// hold capture or a joint account is not the account owner.
+func auditLedgerEntry(tx *sql.Tx, entry LedgerEntry, ledgerID int64) error {
+	var after sql.NullFloat64
+	err := tx.QueryRow("SELECT balance FROM account WHERE username = ?", entry.Username).Scan(&after)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	actor := entry.InitiatedBy
+	if actor == "" {
+		actor = entry.Username
+	}
+	audit := AuditEntry{
+		Actor:   actor,
+		Action:  "ledger." + entry.Type,
+		Account: entry.Username,
+		Outcome: "posted",
+		Detail:  fmt.Sprintf("entry %d: %s", ledgerID, formatAmount(entry.Amount, entry.Currency)),
+	}
+	if entry.Counterparty != "" {
+		audit.Detail += ", counterparty " + entry.Counterparty
+	}
+	if after.Valid {
+		audit.BalanceBefore = sql.NullString{String: fmt.Sprintf("%.4f", after.Float64-entry.Amount), Valid: true}
+		audit.BalanceAfter = sql.NullString{String: fmt.Sprintf("%.4f", after.Float64), Valid: true}
+	}
+	return insertAudit(tx, audit)
+}
+
+func startAuditSealer() {
+	// Each run counts as an operation, so shutdown waits for it to finish,
+	// and no run starts once shutdown has started
+	for startOperation() {
+		sealed, err := sealAuditLog()
+		if err != nil {
+			logger.Error("error sealing audit log", "err", err)
+		}
+		finishOperation()
+		if sealed < auditSealBatch {
+			time.Sleep(auditSealInterval)
+		}
+	}
+}
+
+// sealAuditLog chains the entries written since the last run. Entries are
+// written unsealed, inside the transactions they describe, and sealed here
+// in the order they became visible. The chain head is locked so only one
+// sealer extends it at a time.
+func sealAuditLog() (int, error) {
+	if _, err := db.Exec("INSERT IGNORE INTO audit_head (id, last_seq, last_hash) VALUES (1, 0, '')"); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	var hash string
+	if err := tx.QueryRow("SELECT last_seq, last_hash FROM audit_head WHERE id = 1 FOR UPDATE").Scan(&seq, &hash); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	entries, err := loadAuditEntries(tx, "WHERE seq IS NULL ORDER BY id LIMIT ?", auditSealBatch)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		next, err := entry.ChainHash(seq+1, hash)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE audit_log SET seq = ?, prev_hash = ?, hash = ? WHERE id = ?", seq+1, hash, next, entry.ID); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		seq, hash = seq+1, next
+	}
+	if _, err := tx.Exec("UPDATE audit_head SET last_seq = ?, last_hash = ? WHERE id = 1", seq, hash); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return len(entries), tx.Commit()
+}
+
+func loadAuditEntries(tx *sql.Tx, where string, args ...any) ([]AuditEntry, error) {
+	rows, err := tx.Query("SELECT id, created_at, actor, remote_addr, action, account, balance_before, balance_after, outcome, detail, COALESCE(seq, 0), COALESCE(prev_hash, ''), COALESCE(hash, '') FROM audit_log "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.RemoteAddr, &e.Action, &e.Account, &e.BalanceBefore, &e.BalanceAfter, &e.Outcome, &e.Detail, &e.Seq, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// AuditReport is the result of walking the audit log chain
+type AuditReport struct {
+	Sealed   int64
+	Unsealed int64 // Entries older than auditSealGrace still waiting for the sealer
+	Head     string
+	Problems []string
+	Gaps     []string // Missing IDs around the unsealed entries
+}
+
+func (r AuditReport) String() string {
+	message := fmt.Sprintf("Audit log: %d sealed entries, head %s\n", r.Sealed, r.Head)
+	if r.Unsealed > 0 {
+		message += fmt.Sprintf("%d entries older than %d seconds are not sealed\n", r.Unsealed, auditSealGrace)
+	}
+	if len(r.Gaps) > 0 {
+		message += fmt.Sprintf("%d gaps in unsealed entries, deleted or rolled back before commit:\n", len(r.Gaps))
+		for _, gap := range r.Gaps {
+			message += gap + "\n"
+		}
+	}
+	if len(r.Problems) == 0 {
+		return message + "Chain intact\n"
+	}
+	message += fmt.Sprintf("TAMPERING DETECTED (%d problems):\n", len(r.Problems))
+	for _, problem := range r.Problems {
+		message += problem + "\n"
+	}
+	return message
+}
+
+// verifyAuditLog recomputes the chain over all sealed entries, in sealing
+// order, and checks that it ends at the recorded head. An edited entry fails
+// its hash, a deleted one leaves a gap in seq, and truncating the end no
+// longer matches the head.
+func verifyAuditLog() (AuditReport, error) {
+	var report AuditReport
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	var headSeq int64
+	var headHash string
+	err = tx.QueryRow("SELECT last_seq, last_hash FROM audit_head WHERE id = 1 LOCK IN SHARE MODE").Scan(&headSeq, &headHash)
+	if err != nil && err != sql.ErrNoRows {
+		return report, err
+	}
+	report.Head = headHash
+
+	var seq int64
+	var hash string
+	for {
+		entries, err := loadAuditEntries(tx, "WHERE seq > ? ORDER BY seq LIMIT ?", seq, auditSealBatch)
+		if err != nil {
+			return report, err
+		}
+		for _, e := range entries {
+			if e.Seq != seq+1 {
+				report.Problems = append(report.Problems, fmt.Sprintf("entries %d to %d are missing", seq+1, e.Seq-1))
+			}
+			if e.PrevHash != hash {
+				report.Problems = append(report.Problems, fmt.Sprintf("entry %d (id %d) does not link to the entry before it", e.Seq, e.ID))
+			}
+			expected, err := e.ChainHash(e.Seq, e.PrevHash)
+			if err != nil {
+				return report, err
+			}
+			if expected != e.Hash {
+				report.Problems = append(report.Problems, fmt.Sprintf("entry %d (id %d) was modified", e.Seq, e.ID))
+			}
+			seq, hash = e.Seq, e.Hash
+			report.Sealed++
+		}
+		if len(entries) < auditSealBatch {
+			break
+		}
+	}
+	if seq != headSeq || hash != headHash {
+		report.Problems = append(report.Problems, fmt.Sprintf("chain ends at entry %d but the head is at %d", seq, headSeq))
+	}
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM audit_log WHERE seq IS NULL AND created_at < NOW() - INTERVAL ? SECOND", auditSealGrace).Scan(&report.Unsealed)
+	if err != nil {
+		return report, err
+	}
+	report.Gaps, err = unsealedAuditGaps(tx)
+	return report, err
+}
+
+// unsealedAuditGaps lists the IDs missing from the first unsealed entry on.
+// The chain does not cover those entries yet, so a deleted one only shows as
+// a gap. A transaction rolled back after writing its entry leaves one too,
+// which is why gaps are reported apart from the problems.
+func unsealedAuditGaps(tx *sql.Tx) ([]string, error) {
+	var first sql.NullInt64
+	if err := tx.QueryRow("SELECT MIN(id) FROM audit_log WHERE seq IS NULL").Scan(&first); err != nil || !first.Valid {
+		return nil, err
+	}
+	var prev int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit_log WHERE id < ?", first.Int64).Scan(&prev); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT id FROM audit_log WHERE id >= ? ORDER BY id", first.Int64)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gaps []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		switch {
+		case id == prev+2:
+			gaps = append(gaps, fmt.Sprintf("id %d is missing", prev+1))
+		case id > prev+2:
+			gaps = append(gaps, fmt.Sprintf("ids %d to %d are missing", prev+1, id-1))
+		}
+		prev = id
+	}
+	return gaps, rows.Err()
+}
+
+// runAuditVerifier is the verify-audit command. Its exit status is 1 when
+// tampering is detected and 2 when the log could not be read.
+func runAuditVerifier() int {
+	report, err := verifyAuditLog()
+	if err != nil {
+		logger.Error("error verifying audit log", "err", err)
+		return 2
+	}
+	fmt.Print(report)
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func handleVerifyAuditLog(conn net.Conn, log *slog.Logger, username string) {
+	if !requireAdmin(conn, log, username) {
+		return
+	}
+	report, err := verifyAuditLog()
+	if err != nil {
+		log.Error("error verifying audit log", "err", err)
+		conn.Write([]byte("Error verifying audit log\n"))
+		return
+	}
+	conn.Write([]byte(report.String()))
+}
+
+// Logging
+
+// logger is the server's structured logger, replaced in main with the
+// configured one. Connection handlers are passed the logger of the request
+// they handle instead, which adds the connection and request IDs.
+var logger, _ = newLogger(os.Stdout, "", "", "")
+
+// Words that redact an attribute from the logs when its key contains one, by
+// redaction class, so "stream_balance" is covered by "balance"
+var redactedKeys = map[string][]string{
+	"passwords": {"password", "secret"},
+	"amounts":   {"amount", "balance", "fee"},
+}
+
+// newLogger builds a logger writing text, or JSON when format is "json", at
+// the given level (debug, info, warn or error, default info). redact is a
+// comma-separated list of classes from redactedKeys, "passwords" by default
+// and "none" to log everything. Redaction goes by attribute key only: values
+// inside messages, errors (a LimitError names the limit) or the audit outcome
+// are logged as they are.
+func newLogger(w io.Writer, format, level, redact string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if level != "" {
+		if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+
+	if redact == "" {
+		redact = "passwords"
+	}
+	var redacted []string
+	for _, class := range strings.Split(redact, ",") {
+		class = strings.TrimSpace(class)
+		if class == "none" {
+			continue
+		}
+		keys, ok := redactedKeys[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction class %q", class)
+		}
+		redacted = append(redacted, keys...)
+	}
+
+	options := &slog.HandlerOptions{
+		Level: minLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			for _, word := range redacted {
+				if strings.Contains(a.Key, word) {
+					return slog.String(a.Key, "[REDACTED]")
+				}
+			}
+			return a
+		},
+	}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+func newLogID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// beginRequest gives the n-th request on a connection its ID and returns the
+// logger its handler logs through
+func beginRequest(clientLog *slog.Logger, connID string, n int, option string) *slog.Logger {
+	requestLog := clientLog.With("request_id", fmt.Sprintf("%s-%d", connID, n), "option", option)
+	requestLog.Debug("request received")
+	return requestLog
+}
+
+// Metrics
+
+// Upper bounds in seconds of the command latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type latencyHistogram struct {
+	Counts []int64 // Per bucket, not cumulative
+	Sum    float64
+	Count  int64
+}
+
+// Metrics holds the server's counters. Gauges that can be read from
+// elsewhere, like logged-in users or the database pool, are read when the
+// metrics are scraped instead.
+type Metrics struct {
+	Lock              sync.Mutex
+	ActiveConnections int64
+	Commands          map[string]*latencyHistogram
+	Errors            map[string]int64 // Keyed by response code
+	Retries           map[string]int64 // Keyed by what was retried
+}
+
+var metrics = &Metrics{
+	Commands: make(map[string]*latencyHistogram),
+	Errors:   make(map[string]int64),
+	Retries:  make(map[string]int64),
+}
+
+func (m *Metrics) ConnectionOpened() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.ActiveConnections++
+}
+
+func (m *Metrics) ConnectionClosed() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.ActiveConnections--
+}
+
+func (m *Metrics) ObserveCommand(command string, d time.Duration) {
+	if command == "" {
+		return
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	h, ok := m.Commands[command]
+	if !ok {
+		h = &latencyHistogram{Counts: make([]int64, len(latencyBuckets))}
+		m.Commands[command] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.Counts[i]++
+			break
+		}
+	}
+	h.Sum += seconds
+	h.Count++
+}
+
+func (m *Metrics) CountError(code string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.Errors[code]++
+}
+
+func (m *Metrics) CountRetry(kind string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.Retries[kind]++
+}
+
+// commandLabel keeps the command label to menu numbers so a client sending
+// junk cannot create unbounded series
+func commandLabel(option string) string {
+	if n, err := strconv.Atoi(option); err == nil && n >= 0 && n < 100 {
+		return strconv.Itoa(n)
+	}
+	return "invalid"
+}
+
+// Codes of the "CODE: message" error responses. Only these are counted, so
+// a success message starting with a user-chosen name in capitals is not.
+var responseErrorCodes = map[string]bool{
+	errCodeLimitExceeded:   true,
+	errCodeAccountInactive: true,
+	errCodeShuttingDown:    true,
+}
+
+// Error responses without a code prefix, by the code they are counted under
+var plainErrorCodes = map[string]string{
+	"Internal server error":              "INTERNAL_ERROR",
+	"Permission denied":                  "PERMISSION_DENIED",
+	"Invalid option":                     "INVALID_OPTION",
+	"Invalid username or password":       "INVALID_CREDENTIALS",
+	"Insufficient balance":               "INSUFFICIENT_FUNDS",
+	"Insufficient balance for transfer.": "INSUFFICIENT_FUNDS",
+	"Recipient not found":                "RECIPIENT_NOT_FOUND",
+}
+
+// responseErrorCode returns the code of an error response, either its
+// "CODE: message" prefix or the code of a known plain error, or ""
+func responseErrorCode(response string) string {
+	line, _, _ := strings.Cut(response, "\n")
+	if strings.HasPrefix(line, pushPrefix) {
+		return ""
+	}
+	if code, _, ok := strings.Cut(line, ": "); ok && responseErrorCodes[code] {
+		return code
+	}
+	return plainErrorCodes[line]
+}
+
+// metricsConn counts the error responses written to a client. Every
+// response is written with a single Write, so each call is classified once.
+type metricsConn struct {
+	net.Conn
+}
+
+func (c *metricsConn) Write(b []byte) (int, error) {
+	if code := responseErrorCode(string(b)); code != "" {
+		metrics.CountError(code)
+	}
+	return c.Conn.Write(b)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	m.Lock.Lock()
+	metric("bank_active_connections", "gauge", "Client connections currently open.")
+	fmt.Fprintf(&b, "bank_active_connections %d\n", m.ActiveConnections)
+
+	metric("bank_command_duration_seconds", "histogram", "Time taken to handle a client command, by menu option.")
+	for _, command := range sortedKeys(m.Commands) {
+		h := m.Commands[command]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(&b, "bank_command_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", command, bound, cumulative)
+		}
+		fmt.Fprintf(&b, "bank_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", command, h.Count)
+		fmt.Fprintf(&b, "bank_command_duration_seconds_sum{command=%q} %g\n", command, h.Sum)
+		fmt.Fprintf(&b, "bank_command_duration_seconds_count{command=%q} %d\n", command, h.Count)
+	}
+
+	metric("bank_commands_total", "counter", "Client commands handled, by menu option.")
+	for _, command := range sortedKeys(m.Commands) {
+		fmt.Fprintf(&b, "bank_commands_total{command=%q} %d\n", command, m.Commands[command].Count)
+	}
+
+	metric("bank_errors_total", "counter", "Error responses sent to clients, by code.")
+	for _, code := range sortedKeys(m.Errors) {
+		fmt.Fprintf(&b, "bank_errors_total{code=%q} %d\n", code, m.Errors[code])
+	}
+
+	metric("bank_retries_total", "counter", "Operations retried, by kind: webhook for deliveries.")
+	for _, kind := range sortedKeys(m.Retries) {
+		fmt.Fprintf(&b, "bank_retries_total{kind=%q} %d\n", kind, m.Retries[kind])
+	}
+	m.Lock.Unlock()
+
+	activeUsersLock.Lock()
+	users, sessions := len(activeUsers), 0
+	for _, conns := range activeUsers {
+		sessions += len(conns)
+	}
+	activeUsersLock.Unlock()
+	metric("bank_logged_in_users", "gauge", "Users with at least one logged-in session.")
+	fmt.Fprintf(&b, "bank_logged_in_users %d\n", users)
+	metric("bank_sessions", "gauge", "Logged-in sessions.")
+	fmt.Fprintf(&b, "bank_sessions %d\n", sessions)
+
+	metric("bank_coordinator_in_flight_transactions", "gauge", "Two-phase commit transactions added to the coordinator and not yet finished.")
+	fmt.Fprintf(&b, "bank_coordinator_in_flight_transactions %d\n", coordinator.InFlight())
+
+	stats := db.Stats()
+	metric("bank_db_open_connections", "gauge", "Open database connections, in use or idle.")
+	fmt.Fprintf(&b, "bank_db_open_connections %d\n", stats.OpenConnections)
+	metric("bank_db_in_use_connections", "gauge", "Database connections currently in use.")
+	fmt.Fprintf(&b, "bank_db_in_use_connections %d\n", stats.InUse)
+	metric("bank_db_idle_connections", "gauge", "Idle database connections.")
+	fmt.Fprintf(&b, "bank_db_idle_connections %d\n", stats.Idle)
+	metric("bank_db_wait_count_total", "counter", "Times a database connection had to be waited for.")
+	fmt.Fprintf(&b, "bank_db_wait_count_total %d\n", stats.WaitCount)
+	metric("bank_db_wait_seconds_total", "counter", "Total time spent waiting for a database connection.")
+	fmt.Fprintf(&b, "bank_db_wait_seconds_total %g\n", stats.WaitDuration.Seconds())
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func startHTTPServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := metrics.WriteTo(w); err != nil {
+			logger.Error("error writing metrics", "err", err)
+		}
+	})
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	logger.Info("http listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("error serving http", "err", err)
+	}
+}
+
+// Health Checks
+
+var (
+	listening     atomic.Bool // Set once the client listener is accepting connections
+	draining      atomic.Bool // Set when shutdown starts draining connections
+	healthTimeout = 2 * time.Second
+)
+
+// HealthReport is the body of /healthz and /readyz
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkHealth runs the named checks, each reporting "ok" or what is wrong
+func checkHealth(ctx context.Context, names ...string) HealthReport {
+	report := HealthReport{Status: "ok", Checks: make(map[string]string)}
+	for _, name := range names {
+		result := "ok"
+		switch name {
+		case "database":
+			if err := db.PingContext(ctx); err != nil {
+				result = err.Error()
+			}
+		case "coordinator":
+			if coordinator.Closed() {
+				result = "closed"
+			} else if !coordinator.Recovered() {
+				result = "recovering"
+			}
+		case "listener":
+			if !listening.Load() {
+				result = "not listening"
+			}
+		case "draining":
+			if draining.Load() {
+				result = "shutting down"
+			}
+		}
+		if result != "ok" {
+			report.Status = "fail"
+		}
+		report.Checks[name] = result
+	}
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("error writing health report", "err", err)
+	}
+}
+
+// handleHealthz reports that the process is up and answering. It runs no
+// checks, so an orchestrator does not restart the server while it starts,
+// drains for shutdown or waits for its database.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, checkHealth(r.Context()))
+}
+
+// handleReadyz reports whether the server should be sent clients: its
+// coordinator and listener are up, it reaches its database and is not
+// shutting down
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	writeHealth(w, checkHealth(ctx, "database", "coordinator", "listener", "draining"))
+}
+
+// Graceful Shutdown
+
+const (
+	errCodeShuttingDown  = "SHUTTING_DOWN"
+	shuttingDownResponse = errCodeShuttingDown + ": the server is shutting down, please reconnect later"
+)
+
+var (
+	shutdownTimeout      = 30 * time.Second
+	shutdownPollInterval = 100 * time.Millisecond
+	operationsLock       sync.Mutex
+	operations           int // Client requests and background job runs in flight
+)
+
+// startOperation counts a client request as in flight, unless the server is
+// draining, in which case the request must be refused
+func startOperation() bool {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	if draining.Load() {
+		return false
+	}
+	operations++
+	return true
+}
+
+func finishOperation() {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	operations--
+}
+
+func operationsInFlight() int {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	return operations
+}
+
+// activeSessions returns every logged-in connection
+func activeSessions() []net.Conn {
+	activeUsersLock.Lock()
+	defer activeUsersLock.Unlock()
+	var conns []net.Conn
+	for _, sessions := range activeUsers {
+		conns = append(conns, sessions...)
+	}
+	return conns
+}
+
+// shutdown drains the server once the listener is closed. Connected clients
+// are told, then requests, background job runs and database work already
+// started get up to shutdownTimeout to finish; new requests are refused and
+// background jobs stop starting runs. The coordinator and the audit log are flushed before the
+// sessions are closed. Work cut off by the timeout is rolled back by the
+// database when the connection pool closes.
+func shutdown() {
+	for _, conn := range activeSessions() {
+		writePush(conn, "The server is shutting down. Requests already sent will finish, new ones will be refused.")
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for {
+		operations, transactions, queries := operationsInFlight(), coordinator.InFlight(), db.Stats().InUse
+		if operations == 0 && transactions == 0 && queries == 0 {
+			logger.Info("drained")
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("shutdown timed out while draining", "operations", operations, "transactions", transactions, "db_connections", queries)
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	// Flush the coordinator log: anything still listed did not finish. Data
+	// is left out as it holds amounts, which may have to be redacted.
+	for _, tx := range coordinator.Close() {
+		logger.Warn("coordinator transaction unfinished at shutdown", "id", tx.ID, "operation", tx.Operation)
+	}
+
+	// Seal the audit entries written since the sealer last ran
+	if _, err := sealAuditLog(); err != nil {
+		logger.Error("error sealing audit log", "err", err)
+	}
+
+	for _, conn := range activeSessions() {
+		conn.Close()
+	}
+	if err := db.Close(); err != nil {
+		logger.Error("error closing database", "err", err)
+	}
+	logger.Info("shutdown complete")
+}
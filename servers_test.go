@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRates(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rates.csv")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRateTableLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "USD,EUR,0.92\neur , gbp , 0.86\n", false},
+		{"missing column", "USD,EUR\n", true},
+		{"not a number", "USD,EUR,abc\n", true},
+		{"zero rate", "USD,EUR,0\n", true},
+		{"negative rate", "USD,EUR,-1\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewRateTable()
+			table.Rates["USD/JPY"] = 150
+			err := table.Load(writeRates(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// A bad file leaves the current rates in place
+				if table.Rates["USD/JPY"] != 150 {
+					t.Errorf("rates replaced by a bad file: %v", table.Rates)
+				}
+				return
+			}
+			if _, ok := table.Rates["USD/JPY"]; ok {
+				t.Errorf("old rates kept after a reload: %v", table.Rates)
+			}
+			if table.Rates["EUR/GBP"] != 0.86 {
+				t.Errorf("codes are not normalized: %v", table.Rates)
+			}
+		})
+	}
+
+	if err := NewRateTable().Load(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestRateTableRate(t *testing.T) {
+	table := NewRateTable()
+	if err := table.Load(writeRates(t, "USD,EUR,0.8\nGBP,USD,1.25\n")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from, to string
+		want     float64
+		wantErr  bool
+	}{
+		{"USD", "USD", 1, false},
+		{"USD", "EUR", 0.8, false},
+		{"EUR", "USD", 1.25, false}, // Inverse of USD/EUR
+		{"GBP", "USD", 1.25, false},
+		{"USD", "GBP", 0.8, false},
+		{"EUR", "GBP", 0, true}, // No cross rates
+	}
+	for _, tt := range tests {
+		got, err := table.Rate(tt.from, tt.to)
+		if (err != nil) != tt.wantErr || math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("Rate(%s, %s) = %v, %v, want %v, error %v", tt.from, tt.to, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLargeTransferLimit(t *testing.T) {
+	saved := rateTable
+	defer func() { rateTable = saved }()
+	rateTable = NewRateTable()
+	if err := rateTable.Load(writeRates(t, "USD,JPY,149.5\nUSD,KWD,0.3075\n")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		currency string
+		want     float64
+		wantErr  bool
+	}{
+		{"USD", 1000, false},
+		{"JPY", 149500, false},
+		{"KWD", 307.5, false},
+		{"EUR", 0, true}, // No rate
+	}
+	for _, tt := range tests {
+		got, err := largeTransferLimit(tt.currency)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("largeTransferLimit(%s) = %v, %v, want %v, error %v", tt.currency, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if got := formatLargeTransferLimit("EUR"); got != "USD 1000.00" {
+		t.Errorf("formatLargeTransferLimit(EUR) = %q, want USD 1000.00", got)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             float64
+		wantErr          bool
+	}{
+		{"10.50", "USD", 10.5, false},
+		{"10.505", "USD", 0, true},
+		{"1000", "JPY", 1000, false},
+		{"1000.5", "JPY", 0, true},
+		{"1.125", "KWD", 1.125, false},
+		{"0", "USD", 0, true},
+		{"-5", "USD", 0, true},
+		{"ten", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.amount, tt.currency)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAmount(%q, %s) = %v, %v, want %v, error %v", tt.amount, tt.currency, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	payload := []byte(`{"id":1,"type":"deposit"}`)
+
+	// Reference value computed independently of signWebhook
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(payload)))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("secret", 1700000000, payload); got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+	if signWebhook("other", 1700000000, payload) == want {
+		t.Error("signature does not depend on the secret")
+	}
+	if signWebhook("secret", 1700000001, payload) == want {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"abcdef", 3, "abc"},
+		{"cafés", 4, "café"},
+		{"üüü", 2, "üü"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.max); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		status   string
+		delay    time.Duration
+	}{
+		{1, "pending", 30 * time.Second},
+		{2, "pending", time.Minute},
+		{3, "pending", 2 * time.Minute},
+		{7, "pending", 32 * time.Minute},
+		{webhookMaxAttempts, "dead", 0},
+	}
+	for _, tt := range tests {
+		status, delay := webhookBackoff(tt.attempts)
+		if status != tt.status || delay != tt.delay {
+			t.Errorf("webhookBackoff(%d) = %s, %s, want %s, %s", tt.attempts, status, delay, tt.status, tt.delay)
+		}
+	}
+
+	// The delay is capped however many attempts are allowed
+	defer func(max int) { webhookMaxAttempts = max }(webhookMaxAttempts)
+	webhookMaxAttempts = 100
+	if _, delay := webhookBackoff(20); delay != webhookRetryMax {
+		t.Errorf("delay after 20 attempts = %s, want %s", delay, webhookRetryMax)
+	}
+}
+
+func TestAttemptWebhook(t *testing.T) {
+	var status int
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	d := webhookDelivery{ID: 42, URL: server.URL, Secret: "s3cret", EventType: "deposit", Payload: []byte(`{"id":7}`)}
+
+	// Delivered on a 2xx, with headers the receiver can verify
+	status = http.StatusNoContent
+	outcome := attemptWebhook(d)
+	if outcome.Status != "delivered" || outcome.Attempts != 1 || outcome.Err != nil {
+		t.Fatalf("outcome = %+v, want delivered after 1 attempt", outcome)
+	}
+	if string(body) != `{"id":7}` {
+		t.Errorf("body = %s", body)
+	}
+	if received.Header.Get("X-Webhook-Id") != "42" || received.Header.Get("X-Webhook-Event") != "deposit" {
+		t.Errorf("headers = %v", received.Header)
+	}
+	timestamp, err := strconv.ParseInt(received.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if err != nil {
+		t.Fatalf("timestamp: %v", err)
+	}
+	if got, want := received.Header.Get("X-Webhook-Signature"), "sha256="+signWebhook("s3cret", timestamp, body); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+
+	// Retried with backoff on an error answer
+	status = http.StatusInternalServerError
+	d.Attempts = 2
+	outcome = attemptWebhook(d)
+	if outcome.Status != "pending" || outcome.Attempts != 3 || outcome.Delay != 2*time.Minute || outcome.Err == nil {
+		t.Errorf("outcome = %+v, want pending after 3 attempts with a 2m delay", outcome)
+	}
+
+	// Dead-lettered when the last attempt fails
+	d.Attempts = webhookMaxAttempts - 1
+	outcome = attemptWebhook(d)
+	if outcome.Status != "dead" || outcome.Attempts != webhookMaxAttempts {
+		t.Errorf("outcome = %+v, want dead after %d attempts", outcome, webhookMaxAttempts)
+	}
+
+	// Unreachable endpoints are retried too
+	server.Close()
+	d.Attempts = 0
+	if outcome = attemptWebhook(d); outcome.Status != "pending" || outcome.Err == nil {
+		t.Errorf("outcome = %+v, want pending", outcome)
+	}
+}
+
+func TestFeeRuleCompute(t *testing.T) {
+	some := func(v float64) sql.NullFloat64 { return sql.NullFloat64{Float64: v, Valid: true} }
+	tiers := []FeeTier{{UpTo: some(100), Fee: 1}, {UpTo: some(1000), Fee: 5}, {Fee: 10}}
+	tests := []struct {
+		name   string
+		rule   FeeRule
+		amount float64
+		want   float64
+	}{
+		{"flat", FeeRule{Kind: "flat", FlatAmount: 2.5}, 1000, 2.5},
+		{"percentage", FeeRule{Kind: "percentage", Percentage: 1.5}, 200, 3},
+		{"percentage below minimum", FeeRule{Kind: "percentage", Percentage: 1, MinFee: some(2)}, 50, 2},
+		{"percentage above maximum", FeeRule{Kind: "percentage", Percentage: 1, MaxFee: some(20)}, 5000, 20},
+		{"percentage within bounds", FeeRule{Kind: "percentage", Percentage: 1, MinFee: some(2), MaxFee: some(20)}, 500, 5},
+		{"first tier", FeeRule{Kind: "tiered", Tiers: tiers}, 50, 1},
+		{"tier upper bound is inclusive", FeeRule{Kind: "tiered", Tiers: tiers}, 100, 1},
+		{"middle tier", FeeRule{Kind: "tiered", Tiers: tiers}, 100.01, 5},
+		{"open last tier", FeeRule{Kind: "tiered", Tiers: tiers}, 1e6, 10},
+		{"unknown kind", FeeRule{Kind: "other", FlatAmount: 3}, 100, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Compute(tt.amount); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: Compute(%v) = %v, want %v", tt.name, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func date(s string) time.Time {
+	d, err := time.Parse(dateLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestAmortizationSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		principal   float64
+		rate        float64
+		months      int
+		currency    string
+		payment     float64 // Of every installment but the last
+		lastPayment float64
+	}{
+		{"12% over a year", 10000, 12, 12, "USD", 888.49, 888.47},
+		{"interest free", 1000, 0, 3, "USD", 333.33, 333.34},
+		{"no minor units", 100000, 6, 6, "JPY", 16960, 16957},
+		{"single installment", 500, 12, 1, "USD", 505, 505},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := amortizationSchedule(tt.principal, tt.rate, tt.months, date("2024-01-31"), tt.currency)
+			if len(schedule) != tt.months {
+				t.Fatalf("%d installments, want %d", len(schedule), tt.months)
+			}
+
+			var repaid float64
+			balance := tt.principal
+			for i, inst := range schedule {
+				want := tt.payment
+				if i == len(schedule)-1 {
+					want = tt.lastPayment
+				}
+				if inst.Number != i+1 || inst.Status != "scheduled" {
+					t.Errorf("installment %d: number %d, status %s", i+1, inst.Number, inst.Status)
+				}
+				if math.Abs(inst.Payment-want) > 1e-9 {
+					t.Errorf("installment %d: payment %v, want %v", inst.Number, inst.Payment, want)
+				}
+				if math.Abs(inst.Principal+inst.Interest-inst.Payment) > 1e-9 {
+					t.Errorf("installment %d: %v + %v != %v", inst.Number, inst.Principal, inst.Interest, inst.Payment)
+				}
+				if wantInterest := roundToMinorUnits(balance*tt.rate/100/12, tt.currency); inst.Interest != wantInterest {
+					t.Errorf("installment %d: interest %v, want %v", inst.Number, inst.Interest, wantInterest)
+				}
+				balance = roundToMinorUnits(balance-inst.Principal, tt.currency)
+				if inst.Balance != balance {
+					t.Errorf("installment %d: balance %v, want %v", inst.Number, inst.Balance, balance)
+				}
+				repaid += inst.Principal
+			}
+			if roundToMinorUnits(repaid, tt.currency) != tt.principal || balance != 0 {
+				t.Errorf("repaid %v of %v, %v left", repaid, tt.principal, balance)
+			}
+		})
+	}
+
+	// Due dates are monthly from the first one, clamped to the end of shorter months
+	schedule := amortizationSchedule(300, 0, 3, date("2024-01-31"), "USD")
+	for i, want := range []string{"2024-01-31", "2024-02-29", "2024-03-31"} {
+		if got := schedule[i].DueDate.Format(dateLayout); got != want {
+			t.Errorf("installment %d due %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestAccruedInterest(t *testing.T) {
+	tests := []struct {
+		principal, rate float64
+		since, asOf     string
+		want            float64
+	}{
+		{3650, 10, "2024-01-01", "2024-01-01", 0},
+		{3650, 10, "2024-01-01", "2024-01-02", 1},
+		{3650, 10, "2024-01-01", "2024-01-31", 30},
+		{3650, 0, "2024-01-01", "2024-01-31", 0},
+		{0, 10, "2024-01-01", "2024-01-31", 0},
+	}
+	for _, tt := range tests {
+		if got := accruedInterest(tt.principal, tt.rate, date(tt.since), date(tt.asOf)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("accruedInterest(%v, %v, %s, %s) = %v, want %v", tt.principal, tt.rate, tt.since, tt.asOf, got, tt.want)
+		}
+	}
+}
+
+func TestPayoffQuoteTotal(t *testing.T) {
+	tests := []struct {
+		quote PayoffQuote
+		want  float64
+	}{
+		{PayoffQuote{Principal: 1000, Interest: 12.345, LateFees: 5, Currency: "USD"}, 1017.35},
+		{PayoffQuote{Principal: 1000, Interest: 0.4, Currency: "JPY"}, 1000},
+		{PayoffQuote{Principal: 10.1234, Currency: "KWD"}, 10.123},
+	}
+	for _, tt := range tests {
+		if got := tt.quote.Total(); got != tt.want {
+			t.Errorf("%+v: Total = %v, want %v", tt.quote, got, tt.want)
+		}
+	}
+}
+
+func TestWriteStatementCSV(t *testing.T) {
+	statement := Statement{
+		Account:  "alice",
+		Currency: "USD",
+		Month:    date("2024-02-01"),
+		Opening:  100,
+		Closing:  148.5,
+		Fees:     1.5,
+		Entries: []StatementEntry{
+			{ID: 7, Date: "2024-02-03 10:00:00", Type: "deposit", Amount: 50, Balance: 150},
+			{ID: 8, Date: "2024-02-03 10:00:00", Type: "fee", Counterparty: "bank_revenue_usd", Amount: -1.5, Balance: 148.5},
+		},
+	}
+	var out strings.Builder
+	if err := writeStatementCSV(&out, statement); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"date", "reference", "type", "counterparty", "amount", "balance"},
+		{"2024-02-01", "", "opening_balance", "", "", "100.00"},
+		{"2024-02-03 10:00:00", "7", "deposit", "", "50.00", "150.00"},
+		{"2024-02-03 10:00:00", "8", "fee", "bank_revenue_usd", "-1.50", "148.50"},
+		{"2024-02-29", "", "closing_balance", "", "", "148.50"},
+		{"2024-02-29", "", "total_fees", "", "1.50", ""},
+		{"2024-02-29", "", "total_interest", "", "0.00", ""},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q\nwant %q", records, want)
+	}
+}
+
+func TestPlainAmount(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{1234.5, "USD", "1234.50"},
+		{-0.005, "USD", "-0.01"},
+		{1234.5, "JPY", "1235"},
+		{1.2345, "KWD", "1.235"},
+	}
+	for _, tt := range tests {
+		if got := plainAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("plainAmount(%v, %s) = %s, want %s", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines int
+		pages int
+	}{
+		{"empty", 0, 1},
+		{"one page", 60, 1},
+		{"two pages", 61, 2},
+		{"three pages", 150, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make([]string, tt.lines)
+			for i := range lines {
+				lines[i] = fmt.Sprintf("line %d (with parens) and a \\ backslash", i)
+			}
+			var out bytes.Buffer
+			if err := writePDF(&out, lines); err != nil {
+				t.Fatal(err)
+			}
+			pdf := out.String()
+
+			if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+				t.Fatalf("missing header or trailer:\n%s", pdf)
+			}
+			if !strings.Contains(pdf, fmt.Sprintf("/Count %d ", tt.pages)) {
+				t.Errorf("page count is not %d", tt.pages)
+			}
+			if tt.lines > 0 && !strings.Contains(pdf, `(line 0 \(with parens\) and a \\ backslash) '`) {
+				t.Error("text is not escaped")
+			}
+
+			// startxref points at the table, and every entry at its object
+			var xref int
+			if _, err := fmt.Sscanf(pdf[strings.LastIndex(pdf, "startxref\n"):], "startxref\n%d", &xref); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(pdf[xref:], "xref\n") {
+				t.Fatalf("startxref %d does not point at the xref table", xref)
+			}
+			var count int
+			if _, err := fmt.Sscanf(pdf[xref:], "xref\n0 %d\n", &count); err != nil {
+				t.Fatal(err)
+			}
+			if want := 3 + 2*tt.pages + 1; count != want {
+				t.Errorf("%d xref entries, want %d", count, want)
+			}
+			entries := strings.Split(pdf[xref:], "\n")[3 : 3+count-1]
+			for i, entry := range entries {
+				offset, err := strconv.Atoi(entry[:10])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("%d 0 obj\n", i+1); !strings.HasPrefix(pdf[offset:], want) {
+					t.Errorf("xref entry %d points at %q", i+1, pdf[offset:offset+10])
+				}
+			}
+
+			// Stream lengths match their content
+			for _, part := range strings.Split(pdf, "<< /Length ")[1:] {
+				var length int
+				fmt.Sscanf(part, "%d", &length)
+				start := strings.Index(part, "stream\n") + len("stream\n")
+				if !strings.HasPrefix(part[start+length:], "\nendstream") {
+					t.Errorf("stream length %d does not match its content", length)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteFileBlock(t *testing.T) {
+	data := bytes.Repeat([]byte("%PDF binary \x00\xff"), 20)
+	var out strings.Builder
+	writeFileBlock(&out, "alice-2024-02.pdf", data)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if lines[0] != "FILE alice-2024-02.pdf" || lines[len(lines)-1] != "END FILE" {
+		t.Fatalf("block = %q", out.String())
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) > 76 {
+			t.Errorf("line of %d characters", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("decoded %q, %v", decoded, err)
+	}
+}
+
+func TestNewLoggerRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := newLogger(&buf, "text", "", "passwords,amounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("test", "password", "hunter2", "stream_balance", 12.5, "credited_amount", 3, "account", "alice")
+	out := buf.String()
+	for _, leaked := range []string{"hunter2", "12.5", "credited_amount=3"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log line %q contains %q", out, leaked)
+		}
+	}
+	if !strings.Contains(out, "account=alice") {
+		t.Errorf("log line %q is missing account=alice", out)
+	}
+}
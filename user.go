@@ -2,12 +2,23 @@ package main
 
 import (
 	"bufio"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+// Lines starting with pushPrefix are notifications the server sends at any
+// time. Every other line belongs to the response to the last option, which
+// ends with responseEnd.
+const (
+	pushPrefix  = "PUSH "
+	responseEnd = "Option selection received"
+)
+
 func main() {
 	// Connect to server
 	conn, err := net.Dial("tcp", "localhost:8080")
@@ -39,18 +50,19 @@ func main() {
 		conn.Write([]byte(password))
 
 		// Read response from server
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		serverReader := bufio.NewReader(conn)
+		response, err := serverReader.ReadString('\n')
 		if err != nil {
 			fmt.Println("Error receiving:", err)
 			return
 		}
-		response := string(buffer[:n])
 		fmt.Println(response)
 
-		// If login successful, show options
+		// If login successful, listen for notifications and show options
 		if strings.Contains(response, "Welcome") {
-			showOptions(conn, reader)
+			responses := make(chan string)
+			go receive(serverReader, responses)
+			showOptions(conn, reader, responses)
 		}
 	case "2":
 		// Register
@@ -61,12 +73,18 @@ func main() {
 		name, _ := reader.ReadString('\n')
 		fmt.Print("Enter password: ")
 		password, _ := reader.ReadString('\n')
+		fmt.Print("Enter account currency (default USD): ")
+		currency, _ := reader.ReadString('\n')
+		fmt.Print("Enter account type (checking/savings, default checking): ")
+		accountType, _ := reader.ReadString('\n')
 
 		// Send option and registration details to server
 		conn.Write([]byte("2\n")) // Option 2 for register
 		conn.Write([]byte(username))
 		conn.Write([]byte(name))
 		conn.Write([]byte(password))
+		conn.Write([]byte(currency))
+		conn.Write([]byte(accountType))
 
 		// Read response from server
 		buffer := make([]byte, 1024)
@@ -82,90 +100,1099 @@ func main() {
 	}
 }
 
-func showOptions(conn net.Conn, reader *bufio.Reader) {
-	fmt.Println("Choose an option:")
-	fmt.Println("1. Deposit")
-	fmt.Println("2. Withdraw")
-	fmt.Println("3. Transfer")
-	option, _ := reader.ReadString('\n')
-	option = strings.TrimSpace(option)
+func showOptions(conn net.Conn, reader *bufio.Reader, responses <-chan string) {
+	// Keep the session open until the user exits
+	for {
+		fmt.Println("Choose an option:")
+		fmt.Println("0. Exit")
+		fmt.Println("1. Deposit")
+		fmt.Println("2. Withdraw")
+		fmt.Println("3. Transfer")
+		fmt.Println("4. Schedule transfer")
+		fmt.Println("5. List scheduled transfers")
+		fmt.Println("6. Cancel scheduled transfer")
+		fmt.Println("7. Place hold")
+		fmt.Println("8. List holds")
+		fmt.Println("9. Capture hold")
+		fmt.Println("10. Release hold")
+		fmt.Println("11. Check balance")
+		fmt.Println("12. Reverse transfer")
+		fmt.Println("13. Request money")
+		fmt.Println("14. List payment requests")
+		fmt.Println("15. Respond to payment request")
+		fmt.Println("16. Add payee")
+		fmt.Println("17. List payees")
+		fmt.Println("18. Remove payee")
+		fmt.Println("19. Create joint account")
+		fmt.Println("20. Set joint account permissions")
+		fmt.Println("21. List joint accounts")
+		fmt.Println("22. Joint account operation")
+		fmt.Println("23. Approve joint transfer")
+		fmt.Println("24. Change account status (admin)")
+		fmt.Println("25. Close account")
+		fmt.Println("26. Disburse loan (admin)")
+		fmt.Println("27. List loans")
+		fmt.Println("28. Loan schedule")
+		fmt.Println("29. Loan payoff quote")
+		fmt.Println("30. Pay off loan")
+		fmt.Println("31. Create savings goal")
+		fmt.Println("32. List savings goals")
+		fmt.Println("33. Add savings rule")
+		fmt.Println("34. Move money in or out of a savings goal")
+		fmt.Println("35. Close savings goal")
+		fmt.Println("36. Monthly statement")
+		fmt.Println("37. Add alert")
+		fmt.Println("38. List alerts")
+		fmt.Println("39. Remove alert")
+		fmt.Println("40. Register webhook (admin)")
+		fmt.Println("41. List webhooks (admin)")
+		fmt.Println("42. Remove webhook (admin)")
+		fmt.Println("43. List failed webhook deliveries (admin)")
+		fmt.Println("44. Retry failed webhook delivery (admin)")
+		fmt.Println("45. Event stream status (admin)")
+		fmt.Println("46. Rebuild account from events (admin)")
+		fmt.Println("47. Verify audit log (admin)")
+		option, _ := reader.ReadString('\n')
+		option = strings.TrimSpace(option)
+		if option == "0" {
+			return
+		}
 
-	switch option {
-	case "1":
-		fmt.Println("Deposit now")
-		conn.Write([]byte("1\n")) // Send deposit option
+		switch option {
+		case "1":
+			fmt.Println("Deposit now")
+			conn.Write([]byte("1\n")) // Send deposit option
 
-		// Enter deposit amount
-		fmt.Println("Enter deposit amount:")
-		amountStr, _ := reader.ReadString('\n')
-		amountStr = strings.TrimSpace(amountStr)
+			// Enter deposit amount
+			fmt.Println("Enter deposit amount:")
+			amountStr, _ := reader.ReadString('\n')
+			amountStr = strings.TrimSpace(amountStr)
 
-		// Send deposit amount to server
-		conn.Write([]byte(amountStr + "\n"))
+			// Send deposit amount to server
+			conn.Write([]byte(amountStr + "\n"))
 
-		// Read response from server
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
-		if err != nil {
-			fmt.Println("Error receiving response:", err)
-			return
-		}
-		response := string(buffer[:n])
-		fmt.Println("Received response:", response) // Log the received response
-		fmt.Println(response)
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println("Received response:", response) // Log the received response
+			fmt.Println(response)
 
-	case "2":
-		fmt.Println("Withdraw option selected")
+		case "2":
+			fmt.Println("Withdraw option selected")
 
-		// Send the withdraw option to the server
-		conn.Write([]byte("2\n"))
+			// Send the withdraw option to the server
+			conn.Write([]byte("2\n"))
 
-		// Enter withdraw amount
-		fmt.Println("Enter withdraw amount:")
-		amountStr, _ := reader.ReadString('\n')
-		amountStr = strings.TrimSpace(amountStr)
+			// Enter withdraw amount
+			fmt.Println("Enter withdraw amount:")
+			amountStr, _ := reader.ReadString('\n')
+			amountStr = strings.TrimSpace(amountStr)
 
-		// Send withdraw amount to server
-		conn.Write([]byte(amountStr + "\n"))
+			// Send withdraw amount to server
+			conn.Write([]byte(amountStr + "\n"))
 
-		// Read response from server
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
-		if err != nil {
-			fmt.Println("Error receiving response:", err)
-			return
-		}
-		response := string(buffer[:n])
-		fmt.Println(response)
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
 
-	case "3":
-		fmt.Println("Transfer option selected")
+		case "3":
+			fmt.Println("Transfer option selected")
 
-		// Send the transfer option to the server
-		conn.Write([]byte("3\n"))
+			// Send the transfer option to the server
+			conn.Write([]byte("3\n"))
 
-		// Enter transfer details: recipient username and amount
-		fmt.Println("Enter recipient username:")
-		recipientUsername, _ := reader.ReadString('\n')
-		recipientUsername = strings.TrimSpace(recipientUsername)
-		conn.Write([]byte(recipientUsername + "\n"))
+			// Enter transfer details: recipient username and amount
+			fmt.Println("Enter recipient username or payee nickname:")
+			recipientUsername, _ := reader.ReadString('\n')
+			recipientUsername = strings.TrimSpace(recipientUsername)
+			conn.Write([]byte(recipientUsername + "\n"))
 
-		fmt.Println("Enter transfer amount:")
-		amountStr, _ := reader.ReadString('\n')
-		amountStr = strings.TrimSpace(amountStr)
-		conn.Write([]byte(amountStr + "\n"))
+			fmt.Println("Enter transfer amount:")
+			amountStr, _ := reader.ReadString('\n')
+			amountStr = strings.TrimSpace(amountStr)
+			conn.Write([]byte(amountStr + "\n"))
 
-		// Read response from server
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "4":
+			fmt.Println("Schedule transfer option selected")
+
+			// Send the schedule transfer option to the server
+			conn.Write([]byte("4\n"))
+
+			// Enter standing order details
+			fmt.Println("Enter recipient username:")
+			recipientUsername, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(recipientUsername) + "\n"))
+
+			fmt.Println("Enter transfer amount:")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			fmt.Println("Enter frequency (once/daily/weekly/monthly):")
+			frequency, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(frequency) + "\n"))
+
+			fmt.Println("Enter start date (YYYY-MM-DD):")
+			startDate, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(startDate) + "\n"))
+
+			fmt.Println("Enter end date (YYYY-MM-DD, leave empty for no end):")
+			endDate, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(endDate) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "5":
+			fmt.Println("List scheduled transfers option selected")
+
+			// Send the list option to the server
+			conn.Write([]byte("5\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "6":
+			fmt.Println("Cancel scheduled transfer option selected")
+
+			// Send the cancel option to the server
+			conn.Write([]byte("6\n"))
+
+			fmt.Println("Enter standing order ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "7":
+			fmt.Println("Place hold option selected")
+
+			// Send the place hold option to the server
+			conn.Write([]byte("7\n"))
+
+			// Enter hold details: merchant, amount and validity
+			fmt.Println("Enter merchant username:")
+			merchant, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(merchant) + "\n"))
+
+			fmt.Println("Enter hold amount:")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			fmt.Println("Enter validity in hours:")
+			hours, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(hours) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "8":
+			fmt.Println("List holds option selected")
+
+			// Send the list holds option to the server
+			conn.Write([]byte("8\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "9":
+			fmt.Println("Capture hold option selected")
+
+			// Send the capture option to the server
+			conn.Write([]byte("9\n"))
+
+			fmt.Println("Enter hold ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			fmt.Println("Enter capture amount (leave empty to capture in full):")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "10":
+			fmt.Println("Release hold option selected")
+
+			// Send the release option to the server
+			conn.Write([]byte("10\n"))
+
+			fmt.Println("Enter hold ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "11":
+			// Send the balance option to the server
+			conn.Write([]byte("11\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "12":
+			fmt.Println("Reverse transfer option selected")
+
+			// Send the reverse option to the server
+			conn.Write([]byte("12\n"))
+
+			fmt.Println("Enter transfer reference:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			fmt.Println("Enter refund amount (leave empty to refund the rest):")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "13":
+			fmt.Println("Request money option selected")
+
+			// Send the request money option to the server
+			conn.Write([]byte("13\n"))
+
+			// Enter request details: payer, amount and note
+			fmt.Println("Enter payer username:")
+			payer, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(payer) + "\n"))
+
+			fmt.Println("Enter amount:")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			fmt.Println("Enter note (optional):")
+			note, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(note) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "14":
+			fmt.Println("List payment requests option selected")
+
+			// Send the list option to the server
+			conn.Write([]byte("14\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "15":
+			fmt.Println("Respond to payment request option selected")
+
+			// Send the respond option to the server
+			conn.Write([]byte("15\n"))
+
+			fmt.Println("Enter payment request ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			fmt.Println("Accept or decline?")
+			decision, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(decision) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "16":
+			fmt.Println("Add payee option selected")
+
+			// Send the add payee option to the server
+			conn.Write([]byte("16\n"))
+
+			// Enter payee details: username, nickname and optional limit
+			fmt.Println("Enter payee username:")
+			payee, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(payee) + "\n"))
+
+			fmt.Println("Enter nickname (leave empty to use the username):")
+			nickname, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(nickname) + "\n"))
+
+			fmt.Println("Enter transfer limit for this payee (leave empty for none):")
+			limitStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(limitStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "17":
+			fmt.Println("List payees option selected")
+
+			// Send the list payees option to the server
+			conn.Write([]byte("17\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "18":
+			fmt.Println("Remove payee option selected")
+
+			// Send the remove payee option to the server
+			conn.Write([]byte("18\n"))
+
+			fmt.Println("Enter payee nickname:")
+			nickname, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(nickname) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "19":
+			fmt.Println("Create joint account option selected")
+
+			// Send the create joint account option to the server
+			conn.Write([]byte("19\n"))
+
+			fmt.Println("Enter joint account name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Enter co-owner usernames (comma separated):")
+			coOwners, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(coOwners) + "\n"))
+
+			fmt.Println("Enter amount above which transfers need a second approval (leave empty for none):")
+			threshold, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(threshold) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "20":
+			fmt.Println("Set joint account permissions option selected")
+
+			// Send the permissions option to the server
+			conn.Write([]byte("20\n"))
+
+			fmt.Println("Enter joint account name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Enter owner username:")
+			owner, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(owner) + "\n"))
+
+			fmt.Println("Enter permissions (view,deposit,withdraw,transfer,manage; leave empty to remove the owner):")
+			permissions, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(permissions) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "21":
+			fmt.Println("List joint accounts option selected")
+
+			// Send the list joint accounts option to the server
+			conn.Write([]byte("21\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "22":
+			fmt.Println("Joint account operation option selected")
+
+			// Send the joint operation option to the server
+			conn.Write([]byte("22\n"))
+
+			fmt.Println("Enter joint account name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Enter operation (deposit/withdraw/transfer):")
+			operation, _ := reader.ReadString('\n')
+			operation = strings.TrimSpace(operation)
+			conn.Write([]byte(operation + "\n"))
+
+			fmt.Println("Enter amount:")
+			amountStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amountStr) + "\n"))
+
+			recipient := ""
+			if operation == "transfer" {
+				fmt.Println("Enter recipient username or payee nickname:")
+				recipient, _ = reader.ReadString('\n')
+			}
+			conn.Write([]byte(strings.TrimSpace(recipient) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "23":
+			fmt.Println("Approve joint transfer option selected")
+
+			// Send the approve option to the server
+			conn.Write([]byte("23\n"))
+
+			fmt.Println("Enter pending transfer ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			fmt.Println("Approve or reject?")
+			decision, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(decision) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "24":
+			fmt.Println("Change account status option selected")
+
+			// Send the account status option to the server
+			conn.Write([]byte("24\n"))
+
+			fmt.Println("Enter account:")
+			account, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(account) + "\n"))
+
+			fmt.Println("Enter new status (active/frozen/dormant):")
+			status, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(status) + "\n"))
+
+			fmt.Println("Enter reason:")
+			reason, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(reason) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "25":
+			fmt.Println("Close account option selected")
+
+			// Send the close account option to the server
+			conn.Write([]byte("25\n"))
+
+			fmt.Println("Enter account (leave empty for your own):")
+			account, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(account) + "\n"))
+
+			fmt.Println("Enter account to sweep the remaining balance to (leave empty if the balance is zero):")
+			sweepTo, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(sweepTo) + "\n"))
+
+			fmt.Println("Enter reason (optional):")
+			reason, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(reason) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "26":
+			fmt.Println("Disburse loan option selected")
+
+			// Send the disburse loan option to the server
+			conn.Write([]byte("26\n"))
+
+			fmt.Println("Enter borrower username:")
+			borrower, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(borrower) + "\n"))
+
+			fmt.Println("Enter principal:")
+			principal, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(principal) + "\n"))
+
+			fmt.Println("Enter annual interest rate (%):")
+			rate, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(rate) + "\n"))
+
+			fmt.Println("Enter term in months:")
+			term, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(term) + "\n"))
+
+			fmt.Println("Enter first due date (YYYY-MM-DD, leave empty for one month from today):")
+			firstDue, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(firstDue) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "27":
+			fmt.Println("List loans option selected")
+
+			// Send the list loans option to the server
+			conn.Write([]byte("27\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "28":
+			fmt.Println("Loan schedule option selected")
+
+			// Send the loan schedule option to the server
+			conn.Write([]byte("28\n"))
+
+			fmt.Println("Enter loan ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "29":
+			fmt.Println("Loan payoff quote option selected")
+
+			// Send the payoff quote option to the server
+			conn.Write([]byte("29\n"))
+
+			fmt.Println("Enter loan ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "30":
+			fmt.Println("Pay off loan option selected")
+
+			// Send the pay off loan option to the server
+			conn.Write([]byte("30\n"))
+
+			fmt.Println("Enter loan ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "31":
+			fmt.Println("Create savings goal option selected")
+
+			// Send the create goal option to the server
+			conn.Write([]byte("31\n"))
+
+			fmt.Println("Enter goal name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Enter target amount:")
+			target, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(target) + "\n"))
+
+			fmt.Println("Enter target date (YYYY-MM-DD, leave empty for none):")
+			targetDate, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(targetDate) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "32":
+			fmt.Println("List savings goals option selected")
+
+			// Send the list goals option to the server
+			conn.Write([]byte("32\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "33":
+			fmt.Println("Add savings rule option selected")
+
+			// Send the savings rule option to the server
+			conn.Write([]byte("33\n"))
+
+			fmt.Println("Enter goal name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Enter rule kind (fixed/roundup):")
+			kind, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(kind) + "\n"))
+
+			fmt.Println("Enter amount to set aside, or the unit to round withdrawals up to:")
+			amount, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amount) + "\n"))
+
+			fmt.Println("Enter frequency for fixed rules (weekly/monthly, leave empty for roundup):")
+			frequency, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(frequency) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "34":
+			fmt.Println("Move savings goal money option selected")
+
+			// Send the goal money option to the server
+			conn.Write([]byte("34\n"))
+
+			fmt.Println("Enter goal name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			fmt.Println("Move money in or out?")
+			direction, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(direction) + "\n"))
+
+			fmt.Println("Enter amount:")
+			amount, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(amount) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "35":
+			fmt.Println("Close savings goal option selected")
+
+			// Send the close goal option to the server
+			conn.Write([]byte("35\n"))
+
+			fmt.Println("Enter goal name:")
+			name, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(name) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "36":
+			fmt.Println("Monthly statement option selected")
+
+			// Send the statement option to the server
+			conn.Write([]byte("36\n"))
+
+			fmt.Println("Enter month (YYYY-MM):")
+			month, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(month) + "\n"))
+
+			fmt.Println("Enter joint account (leave blank for your own account):")
+			joint, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(joint) + "\n"))
+
+			// Read response from server and save the statement files it contains
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(saveFiles(response))
+
+		case "37":
+			fmt.Println("Add alert option selected")
+
+			// Send the add alert option to the server
+			conn.Write([]byte("37\n"))
+
+			fmt.Println("Enter alert kind (balance_below/debit_above/new_payee):")
+			kind, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(kind) + "\n"))
+
+			fmt.Println("Enter threshold amount (leave empty for new_payee):")
+			threshold, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(threshold) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "38":
+			fmt.Println("List alerts option selected")
+
+			// Send the list alerts option to the server
+			conn.Write([]byte("38\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "39":
+			fmt.Println("Remove alert option selected")
+
+			// Send the remove alert option to the server
+			conn.Write([]byte("39\n"))
+
+			fmt.Println("Enter alert ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "40":
+			fmt.Println("Register webhook option selected")
+
+			// Send the register webhook option to the server
+			conn.Write([]byte("40\n"))
+
+			fmt.Println("Enter endpoint URL:")
+			url, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(url) + "\n"))
+
+			fmt.Println("Enter event types (deposit,withdraw,transfer or * for all):")
+			events, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(events) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "41":
+			fmt.Println("List webhooks option selected")
+
+			// Send the list webhooks option to the server
+			conn.Write([]byte("41\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "42":
+			fmt.Println("Remove webhook option selected")
+
+			// Send the remove webhook option to the server
+			conn.Write([]byte("42\n"))
+
+			fmt.Println("Enter webhook ID:")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "43":
+			fmt.Println("List failed webhook deliveries option selected")
+
+			// Send the failed deliveries option to the server
+			conn.Write([]byte("43\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "44":
+			fmt.Println("Retry failed webhook delivery option selected")
+
+			// Send the retry delivery option to the server
+			conn.Write([]byte("44\n"))
+
+			fmt.Println("Enter delivery ID (or all):")
+			idStr, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(idStr) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "45":
+			fmt.Println("Event stream status option selected")
+
+			// Send the event stream status option to the server
+			conn.Write([]byte("45\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "46":
+			fmt.Println("Rebuild account option selected")
+
+			// Send the rebuild account option to the server
+			conn.Write([]byte("46\n"))
+
+			fmt.Println("Enter account:")
+			account, _ := reader.ReadString('\n')
+			conn.Write([]byte(strings.TrimSpace(account) + "\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		case "47":
+			fmt.Println("Verify audit log option selected")
+
+			// Send the verify audit log option to the server
+			conn.Write([]byte("47\n"))
+
+			// Read response from server
+			response, err := readResponse(responses)
+			if err != nil {
+				fmt.Println("Error receiving response:", err)
+				return
+			}
+			fmt.Println(response)
+
+		default:
+			fmt.Println("Invalid option")
+		}
+	}
+}
+
+// receive reads everything the server sends. Notifications are printed as
+// soon as they arrive, the other lines are passed on to readResponse.
+func receive(serverReader *bufio.Reader, responses chan<- string) {
+	defer close(responses)
+	for {
+		line, err := serverReader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error receiving response:", err)
 			return
 		}
-		response := string(buffer[:n])
-		fmt.Println(response)
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, pushPrefix) {
+			fmt.Println("\n*** Notification: " + strings.TrimPrefix(line, pushPrefix))
+			continue
+		}
+		responses <- line
+	}
+}
 
-	default:
-		fmt.Println("Invalid option")
+// saveFiles writes the files sent in a response to the current directory
+// and returns the rest of the response, with a line for each saved file.
+// A file is sent as a "FILE <name>" line, base64 lines and "END FILE".
+func saveFiles(response string) string {
+	var text []string
+	var name string
+	var encoded strings.Builder
+	for _, line := range strings.Split(response, "\n") {
+		switch {
+		case name == "" && strings.HasPrefix(line, "FILE "):
+			name = filepath.Base(strings.TrimPrefix(line, "FILE "))
+			encoded.Reset()
+		case name != "" && line == "END FILE":
+			data, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err == nil {
+				err = os.WriteFile(name, data, 0o644)
+			}
+			if err != nil {
+				text = append(text, fmt.Sprintf("Error saving %s: %v", name, err))
+			} else {
+				text = append(text, "Saved "+name)
+			}
+			name = ""
+		case name != "":
+			encoded.WriteString(line)
+		default:
+			text = append(text, line)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// readResponse collects the lines of one response
+func readResponse(responses <-chan string) (string, error) {
+	var lines []string
+	for line := range responses {
+		if line == responseEnd {
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
 	}
+	return "", errors.New("connection closed by server")
 }